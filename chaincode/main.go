@@ -3,14 +3,21 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"log"
+	"math/big"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
@@ -22,32 +29,199 @@ type SmartContract struct {
 	contractapi.Contract
 }
 
+// Config 为链码全局配置，由 InitLedger 写入
+type Config struct {
+	Admins []string `json:"admins"` // 管理员 userID，需先通过 Register 注册公钥
+	// TestMode 仅供 Caliper 压测：AddResource 额外接受只覆盖 uid 的静态签名
+	// 只能由带 bootstrapAttr 的运营方身份在 InitLedger 时开启，之后没有任何交易可以修改
+	TestMode bool `json:"testMode"`
+	// InitializedBy 记录执行 InitLedger 的 Fabric 身份 (MSP ID 与证书主体)，供审计谁选择了 TestMode
+	InitializedBy string `json:"initializedBy,omitempty"`
+	// LegacyUserIDs 为 true 时 Register 接受任意 userID，供沿用旧版自由格式 ID 的部署；由管理员 SetLegacyUserIDs 开关
+	LegacyUserIDs bool `json:"legacyUserIDs"`
+	// DefaultRole 为自助 Register 唯一允许的角色，空串表示 defaultSelfRole；由管理员 SetDefaultRole 修改
+	DefaultRole string `json:"defaultRole,omitempty"`
+}
+
+// selfRegisterRole 返回自助 Register 当前允许的角色
+func (c *Config) selfRegisterRole() string {
+	if c.DefaultRole == "" {
+		return defaultSelfRole
+	}
+	return c.DefaultRole
+}
+
 type User struct {
-	PK   string `json:"pk"`
-	Role string `json:"role"`
+	PK     string   `json:"pk"`
+	KeyAlg string   `json:"keyAlg"` // keyAlgRSA / keyAlgECDSA / keyAlgEd25519，由 Register 根据公钥类型写入
+	Roles  []string `json:"roles"`
+	// Role 为旧版单角色字段，QueryUserID 读取时并入 Roles，新记录不再写入
+	Role string `json:"role,omitempty" metadata:",optional"`
+	// Status 为空表示正常；userStatusSuspended 可由管理员恢复，userStatusRevoked 不可恢复
+	Status string `json:"status,omitempty" metadata:",optional"`
+	// PrevKeys 为 RotateKey 替换下来的历史公钥指纹，仅供审计
+	PrevKeys []RetiredKey `json:"prevKeys,omitempty" metadata:",optional"`
+	// PeerID 为 BindPeer 绑定的 libp2p 节点 ID
+	PeerID string `json:"peerID,omitempty" metadata:",optional"`
+
+	// legacy 表示记录读自旧版单角色格式，其角色尚未写入 role~uid 索引
+	legacy bool
+}
+
+type RetiredKey struct {
+	Fingerprint string    `json:"fingerprint"` // 公钥 DER (SPKI) 的 SHA-256，hex
+	KeyAlg      string    `json:"keyAlg"`
+	RetiredAt   time.Time `json:"retiredAt"`
 }
 
 type Resource struct {
 	OwnerUID string    `json:"ownerUID"`
 	CID      string    `json:"cid"`
 	Created  time.Time `json:"created"`
+	// PendingOwnerUID 为 OfferOwnership 指定、尚未 AcceptOwnership 的接收方
+	PendingOwnerUID string              `json:"pendingOwnerUID,omitempty" metadata:",optional"`
+	Transfers       []OwnershipTransfer `json:"transfers,omitempty" metadata:",optional"`
+	// 墓碑标记：RemoveResource 后记录保留，cid 不可再次注册
+	Tombstone *Tombstone `json:"tombstone,omitempty" metadata:",optional"`
+	// Admins 为属主委派的策略管理员，可代为管理授权与拒绝规则，但不能删除资源或转移属主
+	Admins []ResourceAdmin `json:"admins,omitempty" metadata:",optional"`
+}
+
+type ResourceAdmin struct {
+	UID         string `json:"uid"`
+	CanDelegate bool   `json:"canDelegate"` // 为 true 时该管理员可继续委派其他管理员
+	AddedBy     string `json:"addedBy"`
+}
+
+type Tombstone struct {
+	RemovedBy string    `json:"removedBy"`
+	RemovedAt time.Time `json:"removedAt"`
+}
+
+// OwnershipTransfer 记录一次已完成的属主变更
+type OwnershipTransfer struct {
+	FromUID string    `json:"fromUID"`
+	ToUID   string    `json:"toUID"`
+	Time    time.Time `json:"time"`
+}
+
+type RoleEdge struct {
+	Senior string `json:"senior"`
+	Junior string `json:"junior"`
 }
 
 type AccessLog struct {
-	UID      string    `json:"uid"`
-	Decision string    `json:"decision"` // "Permit" or "Deny"
-	Time     time.Time `json:"time"`
+	UID       string    `json:"uid"`
+	Decision  string    `json:"decision"` // "Permit", "Deny", "Revoke" or "Remove"
+	Time      time.Time `json:"time"`     // 交易时间戳，各背书节点一致
+	TxID      string    `json:"txID,omitempty" metadata:",optional"`
+	Operation string    `json:"operation,omitempty" metadata:",optional"`
+	Role      string    `json:"role,omitempty" metadata:",optional"`      // CheckPerm 中命中授权的持有角色
+	Roles     []string  `json:"roles,omitempty" metadata:",optional"`     // CheckPerm 中参与评估的持有角色；Revoke 中为失去权限的角色
+	Reason    string    `json:"reason,omitempty" metadata:",optional"`    // Deny 的具体原因
+	Rule      string    `json:"rule,omitempty" metadata:",optional"`      // 导致拒绝的 deny 规则主体，如 "user:<uid>"
+	GrantType string    `json:"grantType,omitempty" metadata:",optional"` // 命中或撤销的授权类型: "role" 或 "user"
+	Target    string    `json:"target,omitempty" metadata:",optional"`    // 用户授权被撤销时的目标 userID
+	CID       string    `json:"cid,omitempty" metadata:",optional"`       // 仅 TraceUser 返回时填充
+	// 仅未通过认证的记录：请求中声称的 userID，未经验证，此时 UID 为空
+	ClaimedUID string `json:"claimedUID,omitempty" metadata:",optional"`
 }
 
+// AccessLog.Reason 的取值，供链下按原因统计
 const (
+	denyReasonUnknownUser     = "unknown_user"
+	denyReasonUserSuspended   = "user_suspended"
+	denyReasonUserRevoked     = "user_revoked"
+	denyReasonBadSignature    = "bad_signature"
+	denyReasonNoPolicy        = "no_policy"
+	denyReasonResourceRemoved = "resource_removed"
+	denyReasonGrantExpired    = "grant_expired"
+	denyReasonGrantNotYet     = "grant_not_yet_valid"
+	denyReasonDenyRule        = "deny_rule"
+
+	grantTypeRole = "role"
+	grantTypeUser = "user"
+)
+
+// PolicyGrant 为 policy 组合键的值，记录授权的有效期；旧版 0x01 标记视为无期限授权
+type PolicyGrant struct {
+	NotBefore *time.Time `json:"notBefore,omitempty"`
+	NotAfter  *time.Time `json:"notAfter,omitempty"`
+}
+
+// inactiveReason 返回授权在 t 时刻不生效的原因，生效时返回 ""
+func (g *PolicyGrant) inactiveReason(t time.Time) string {
+	if g.NotBefore != nil && t.Before(*g.NotBefore) {
+		return denyReasonGrantNotYet
+	}
+	if g.NotAfter != nil && !t.Before(*g.NotAfter) {
+		return denyReasonGrantExpired
+	}
+	return ""
+}
+
+// compositeKeyNamespace 为 Fabric 组合键的首字节
+const compositeKeyNamespace = "\x00"
+
+const (
+	// roleSetKeyPrefix 沿用旧版的普通键，AddResource 不接受同名 cid
 	roleSetKeyPrefix = "roleSet"
+	// configKey 与 roleIndexKey 采用 CreateCompositeKey(objType, nil) 的格式，以 \x00 开头，不会与 cid 或 userID 冲突
+	configKey = "\x00config\x00"
+	// roleIndexKey 存在表示每个用户的角色都已写入 role~uid 索引：新账本建立角色集合时写入，
+	// 旧版升级的账本须由管理员 BackfillRoleIndex 迁移全部旧用户后写入
+	roleIndexKey = "\x00roleIndexComplete\x00"
 	// rolePermKeyPref 被废弃，改为使用 CompositeKey "policy"
 	policyObjType = "policy"
+	// 角色到用户的反向索引，用于 RemoveRole 判断角色是否仍被使用
+	roleUserObjType = "role~uid"
+	// 角色继承边: senior 继承 junior 的全部权限
+	roleEdgeObjType = "roleEdge"
+	// 已使用的签名 nonce，属性为 [expiry, uid, nonce]；expiry 补零到固定宽度，使组合键按过期时间排序
+	nonceObjType = "nonce"
+	// 显式拒绝规则，属性为 [cid, subject, operation]，subject 形如 "role:<role>" 或 "user:<uid>"
+	denyObjType = "deny"
+	// 直接授予用户的权限，属性为 [cid, uid, operation]，值与 policy 相同为 PolicyGrant
+	userPolicyObjType = "userpolicy"
+	// libp2p 节点 ID 到用户的绑定，属性为 [peerID]，值为 PeerBinding
+	peerUserObjType = "peer~uid"
+	// 访问日志的按用户二级索引，属性为 [uid, txid, cid]；同一交易可能为多个 cid 写日志
+	uidLogObjType = "uidlog~uid~txid"
+	// 未通过认证 (unknown_user / bad_signature) 的拒绝记录，属性为 [cid, txid]；不写入 cid 日志与 uidlog 索引
+	unauthLogObjType = "unauthlog~cid~txid"
+)
+
+// auditorRole 的持有者 (含其上级角色) 可通过 TraceUser 查询任意用户的访问记录；该角色需由管理员 AddRole 创建
+const auditorRole = "Auditor"
+
+var defaultSystemRoles = []string{"Creator", "Contributor", "Public"}
+
+const (
+	// defaultSelfRole 为未配置 DefaultRole 时自助注册可获得的角色
+	defaultSelfRole = "Public"
+	// registrarAttr 为 Fabric 客户端证书属性，值为 "true" 的身份可直接 Register 任意角色
+	registrarAttr = "rbac.registrar"
+	// bootstrapAttr 为运营方的 Fabric 客户端证书属性，只有值为 "true" 的身份可以执行 InitLedger
+	bootstrapAttr = "rbac.bootstrap"
 )
 
+// 默认继承关系: Creator ⊇ Contributor ⊇ Public
+var defaultRoleEdges = []RoleEdge{
+	{Senior: "Creator", Junior: "Contributor"},
+	{Senior: "Contributor", Junior: "Public"},
+}
+
 /* ---------- 工具 ---------- */
 
-func parsePublicKeyPEM(pubPEM string) (*rsa.PublicKey, error) {
+// 用户公钥算法，记录在 User.KeyAlg；签名一律覆盖同一 payload
+const (
+	keyAlgRSA     = "RSA"        // PKCS#1 v1.5 或 PSS，SHA-256
+	keyAlgECDSA   = "ECDSA-P256" // SHA-256，签名为 ASN.1 DER 或 64 字节 r||s
+	keyAlgEd25519 = "Ed25519"    // 直接对 payload 签名，不预先哈希
+)
+
+// parsePublicKeyPEM 解析 PKIX ("PUBLIC KEY") 公钥，接受 RSA、ECDSA P-256 与 Ed25519
+func parsePublicKeyPEM(pubPEM string) (crypto.PublicKey, error) {
 	block, _ := pem.Decode([]byte(pubPEM))
 	if block == nil || block.Type != "PUBLIC KEY" {
 		return nil, fmt.Errorf("invalid PEM public key")
@@ -56,37 +230,232 @@ func parsePublicKeyPEM(pubPEM string) (*rsa.PublicKey, error) {
 	if err != nil {
 		return nil, fmt.Errorf("parse public key failed: %v", err)
 	}
-	rsaPub, ok := pub.(*rsa.PublicKey)
-	if !ok {
-		return nil, fmt.Errorf("public key is not RSA")
+	if keyAlgorithm(pub) == "" {
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+	return pub, nil
+}
+
+// keyAlgorithm 返回公钥对应的算法名，不支持的类型返回 ""
+func keyAlgorithm(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return keyAlgRSA
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P256() {
+			return keyAlgECDSA
+		}
+	case ed25519.PublicKey:
+		return keyAlgEd25519
+	}
+	return ""
+}
+
+// keyFingerprint 返回已解析公钥重新编码后 DER (SPKI) 的 SHA-256 (hex)，即 userID 与历史公钥指纹
+// 不直接哈希提交的 PEM 块，使指纹只取决于公钥本身
+func keyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("marshal public key failed: %v", err)
 	}
-	return rsaPub, nil
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
 }
 
-func verifySignature(uid, cid, sigB64 string, pub *rsa.PublicKey) error {
-	data := uid + cid
-	sum := sha256.Sum256([]byte(data))
+// verifyPayloadSignature 按公钥类型校验 base64 签名
+func verifyPayloadSignature(payload []byte, sigB64 string, pub crypto.PublicKey) error {
 	sig, err := base64.StdEncoding.DecodeString(sigB64)
 	if err != nil {
 		return fmt.Errorf("decode signature failed: %v", err)
 	}
-	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
-		return fmt.Errorf("invalid signature: %v", err)
+	sum := sha256.Sum256(payload)
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, sum[:], sig); err != nil {
+			if rsa.VerifyPSS(k, crypto.SHA256, sum[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}) != nil {
+				return fmt.Errorf("invalid signature: %v", err)
+			}
+		}
+	case *ecdsa.PublicKey:
+		// WebCrypto 等输出定长 r||s，其余实现多为 ASN.1 DER；DER 签名也可能恰为 64 字节，定长校验失败时再按 DER 校验
+		ok := false
+		if len(sig) == 64 {
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			ok = ecdsa.Verify(k, sum[:], r, s)
+		}
+		if !ok {
+			ok = ecdsa.VerifyASN1(k, sum[:], sig)
+		}
+		if !ok {
+			return fmt.Errorf("invalid signature: ecdsa verification failed")
+		}
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, payload, sig) {
+			return fmt.Errorf("invalid signature: ed25519 verification failed")
+		}
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
 	}
 	return nil
 }
 
-func verifySignature_for_caliper(uid, sigB64 string, pub *rsa.PublicKey) error {
-	data := uid
-	sum := sha256.Sum256([]byte(data))
-	sig, err := base64.StdEncoding.DecodeString(sigB64)
+/* ---------- 防重放签名凭据 ---------- */
+
+// SignedProof 为客户端随交易提交的签名凭据 (JSON)，取代原先只覆盖 uid+cid 的裸签名
+type SignedProof struct {
+	Nonce     string `json:"nonce"`
+	Expiry    int64  `json:"expiry"` // Unix 秒，按交易时间戳判定是否过期
+	Signature string `json:"sig"`    // base64，对 canonicalPayload 的签名，算法随用户公钥而定 (见 verifyPayloadSignature)
+}
+
+// canonicalPayload 构造被签名的字节串：函数名、全部业务参数（按调用顺序，不含凭据本身）、nonce、expiry
+// 每个字段编码为 "<字节长度>:<内容>,"，避免直接拼接带来的歧义
+func canonicalPayload(fn string, args []string, nonce string, expiry int64) []byte {
+	fields := make([]string, 0, len(args)+3)
+	fields = append(fields, fn)
+	fields = append(fields, args...)
+	fields = append(fields, nonce, strconv.FormatInt(expiry, 10))
+
+	var buf []byte
+	for _, f := range fields {
+		buf = strconv.AppendInt(buf, int64(len(f)), 10)
+		buf = append(buf, ':')
+		buf = append(buf, f...)
+		buf = append(buf, ',')
+	}
+	return buf
+}
+
+// txTime 返回提案时间戳，各背书节点一致
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	ts, err := ctx.GetStub().GetTxTimestamp()
 	if err != nil {
-		return fmt.Errorf("decode signature failed: %v", err)
+		return time.Time{}, fmt.Errorf("get tx timestamp failed: %v", err)
 	}
-	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
-		return fmt.Errorf("invalid signature: %v", err)
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// maxProofTTL 为凭据有效期的上限 (秒)，限制泄露凭据在只读查询中的重放窗口，并保证 nonce 记录能被及时清理
+const maxProofTTL = 3600
+
+// checkProof 校验凭据未过期且签名覆盖 fn(args...)，不检查也不登记 nonce
+// 只读查询通过 EvaluateTransaction 调用，写入不会提交，因此只能依赖 expiry 限制重放窗口
+func checkProof(ctx contractapi.TransactionContextInterface, pub crypto.PublicKey, fn, proofJSON string, args ...string) (*SignedProof, error) {
+	var proof SignedProof
+	if err := json.Unmarshal([]byte(proofJSON), &proof); err != nil {
+		return nil, fmt.Errorf("parse signed proof failed: %v", err)
 	}
-	return nil
+	if proof.Nonce == "" {
+		return nil, fmt.Errorf("signed proof missing nonce")
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now.Unix() >= proof.Expiry {
+		return nil, fmt.Errorf("signed proof expired at %d", proof.Expiry)
+	}
+	if proof.Expiry-now.Unix() > maxProofTTL {
+		return nil, fmt.Errorf("signed proof expiry %d is more than %d seconds ahead", proof.Expiry, maxProofTTL)
+	}
+
+	payload := canonicalPayload(fn, args, proof.Nonce, proof.Expiry)
+	if err := verifyPayloadSignature(payload, proof.Signature, pub); err != nil {
+		return nil, err
+	}
+	return &proof, nil
+}
+
+// nonceExpiry 把 expiry 编码为固定宽度的十进制串，供 nonce 组合键按时间排序
+func nonceExpiry(expiry int64) string {
+	return fmt.Sprintf("%020d", expiry)
+}
+
+// verifyProof 在 checkProof 的基础上要求 nonce 未被该用户用过，通过后登记 nonce
+// expiry 在签名覆盖范围内，重放的凭据必然带相同的 expiry，因此可以把 expiry 放进 nonce 键
+func verifyProof(ctx contractapi.TransactionContextInterface, userID string, pub crypto.PublicKey, fn, proofJSON string, args ...string) error {
+	proof, err := checkProof(ctx, pub, fn, proofJSON, args...)
+	if err != nil {
+		return err
+	}
+
+	nonceKey, err := ctx.GetStub().CreateCompositeKey(nonceObjType, []string{nonceExpiry(proof.Expiry), userID, proof.Nonce})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	used, err := ctx.GetStub().GetState(nonceKey)
+	if err != nil {
+		return fmt.Errorf("get nonce failed: %v", err)
+	}
+	if used != nil {
+		return fmt.Errorf("nonce %s already used by %s", proof.Nonce, userID)
+	}
+	return ctx.GetStub().PutState(nonceKey, []byte{0x01})
+}
+
+// PurgeExpiredNonces(proofJSON, adminID) 删除已过期的 nonce 记录，返回删除数量
+// 过期的凭据在 checkProof 中已被拒绝，其 nonce 不再需要保留；每次最多删除 batchMaxSize 条，返回值为 batchMaxSize 时应继续调用
+func (s *SmartContract) PurgeExpiredNonces(ctx contractapi.TransactionContextInterface, proofJSON, adminID string) (int, error) {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "PurgeExpiredNonces"); err != nil {
+		return 0, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return 0, err
+	}
+	it, err := ctx.GetStub().GetStateByPartialCompositeKey(nonceObjType, []string{})
+	if err != nil {
+		return 0, fmt.Errorf("get nonces failed: %v", err)
+	}
+	defer it.Close()
+
+	cutoff := nonceExpiry(now.Unix())
+	purged := 0
+	for purged < batchMaxSize && it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		_, attrs, err := ctx.GetStub().SplitCompositeKey(kv.Key)
+		if err != nil {
+			return 0, fmt.Errorf("split composite key failed: %v", err)
+		}
+		// 键按 expiry 升序排列，遇到未过期的记录即可停止
+		if len(attrs) != 3 || attrs[0] > cutoff {
+			break
+		}
+		if err := ctx.GetStub().DelState(kv.Key); err != nil {
+			return 0, fmt.Errorf("delete nonce failed: %v", err)
+		}
+		purged++
+	}
+
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventNoncesPurged, UID: adminID}); err != nil {
+		return 0, err
+	}
+	log.Printf("[PurgeExpiredNonces] purged=%d admin=%s", purged, adminID)
+	return purged, nil
+}
+
+// authenticate 读取 userID 并校验其对 fn(args...) 的签名凭据
+func (s *SmartContract) authenticate(ctx contractapi.TransactionContextInterface, userID, fn, proofJSON string, args ...string) (*User, error) {
+	u, err := s.QueryUserID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUserActive(userID, u); err != nil {
+		return nil, err
+	}
+	pub, err := parsePublicKeyPEM(u.PK)
+	if err != nil {
+		return nil, fmt.Errorf("parse pubkey failed: %v", err)
+	}
+	if err := verifyProof(ctx, userID, pub, fn, proofJSON, args...); err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
 /* ---------- 角色集合管理 (仅保留角色定义，不再存储大权限列表) ---------- */
@@ -114,277 +483,2587 @@ func putRoleSet(ctx contractapi.TransactionContextInterface, roles []string) err
 	return ctx.GetStub().PutState(roleSetKeyPrefix, b)
 }
 
-func ensureSystemRolesInitialized(ctx contractapi.TransactionContextInterface) error {
+// ensureSystemRolesInitialized 返回当前角色集合，首次调用时写入默认角色
+// Fabric 交易内读不到本交易的写入，因此调用方应直接使用返回值而非再次 getRoleSet
+func ensureSystemRolesInitialized(ctx contractapi.TransactionContextInterface) ([]string, error) {
 	roles, err := getRoleSet(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if roles != nil {
-		return nil
+		return roles, nil
 	}
 	// 初始化角色列表，但不再初始化空的 rolePerms，因为我们改用组合键了
-	defaultRoles := []string{"Creator", "Contributor", "Public"}
-	if err := putRoleSet(ctx, defaultRoles); err != nil {
-		return err
+	if err := putRoleSet(ctx, defaultSystemRoles); err != nil {
+		return nil, err
 	}
-	return nil
+	// 角色集合不存在说明账本上没有旧版用户，此后注册的用户都会写入 role~uid 索引
+	if err := ctx.GetStub().PutState(roleIndexKey, []byte{0x01}); err != nil {
+		return nil, err
+	}
+	for _, e := range defaultRoleEdges {
+		if err := putRoleEdge(ctx, e.Senior, e.Junior); err != nil {
+			return nil, err
+		}
+	}
+	return defaultSystemRoles, nil
 }
 
-/* ---------- 新增：基于组合键的权限管理工具 ---------- */
+func containsString(list []string, v string) bool {
+	for _, x := range list {
+		if x == v {
+			return true
+		}
+	}
+	return false
+}
 
-// putPolicyEntry 使用组合键写入权限
-// Key 结构: policy + role + cid + operation
-// 优势: 不同的 (role, cid) 组合会生成完全不同的 Key，互不冲突
-func putPolicyEntry(ctx contractapi.TransactionContextInterface, role, cid, operation string) error {
-	// 创建组合键: indexName="policy", attributes=[role, cid, operation]
-	compositeKey, err := ctx.GetStub().CreateCompositeKey(policyObjType, []string{role, cid, operation})
+// hasPartialCompositeKey 判断是否存在以 attrs 为前缀的组合键
+func hasPartialCompositeKey(ctx contractapi.TransactionContextInterface, objType string, attrs []string) (bool, error) {
+	it, err := ctx.GetStub().GetStateByPartialCompositeKey(objType, attrs)
 	if err != nil {
-		return fmt.Errorf("create composite key failed: %v", err)
+		return false, fmt.Errorf("get state by partial composite key failed: %v", err)
 	}
-
-	// 写入空值或 "1" 即可，Key 的存在即代表有权限
-	// 这是一个 Blind Write (盲写)，不需要先 Read，彻底消除 MVCC 读写冲突
-	return ctx.GetStub().PutState(compositeKey, []byte{0x01})
+	defer it.Close()
+	return it.HasNext(), nil
 }
 
-// hasPolicyEntry 检查权限
-func hasPolicyEntry(ctx contractapi.TransactionContextInterface, role, cid, operation string) (bool, error) {
-	compositeKey, err := ctx.GetStub().CreateCompositeKey(policyObjType, []string{role, cid, operation})
-	if err != nil {
-		return false, fmt.Errorf("create composite key failed: %v", err)
+// validatePlainKey 拒绝空串、保留的普通键以及组合键前缀；cid 与 userID 直接作为状态键，与全局状态共用同一键空间
+func validatePlainKey(kind, key string) error {
+	if key == "" {
+		return fmt.Errorf("%s must not be empty", kind)
 	}
+	if key == roleSetKeyPrefix || strings.HasPrefix(key, compositeKeyNamespace) {
+		return fmt.Errorf("%s %q is reserved", kind, key)
+	}
+	return nil
+}
 
-	val, err := ctx.GetStub().GetState(compositeKey)
+/* ---------- 全局配置与管理员 ---------- */
+
+func getConfig(ctx contractapi.TransactionContextInterface) (*Config, error) {
+	b, err := ctx.GetStub().GetState(configKey)
 	if err != nil {
-		return false, err
+		return nil, fmt.Errorf("get config failed: %v", err)
+	}
+	var cfg Config
+	if b == nil {
+		return &cfg, nil
 	}
-	return val != nil, nil
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, fmt.Errorf("unmarshal config failed: %v", err)
+	}
+	return &cfg, nil
 }
 
-/* ---------- 用户注册与查询 ---------- */
+// InitLedger(adminsJSON, testMode) 写入管理员列表并初始化系统角色，只允许执行一次
+// 提交者的 Fabric 客户端证书须带有 bootstrapAttr=true；列出的管理员须已注册
+func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface, adminsJSON string, testMode bool) error {
+	if err := ctx.GetClientIdentity().AssertAttributeValue(bootstrapAttr, "true"); err != nil {
+		return fmt.Errorf("permission denied: InitLedger requires the %s client attribute: %v", bootstrapAttr, err)
+	}
+	existing, err := ctx.GetStub().GetState(configKey)
+	if err != nil {
+		return fmt.Errorf("get config failed: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("ledger already initialized")
+	}
 
-func (s *SmartContract) Register(ctx contractapi.TransactionContextInterface, userID, publicKeyPEM, role string) error {
-	if err := ensureSystemRolesInitialized(ctx); err != nil {
+	mspID, err := ctx.GetClientIdentity().GetMSPID()
+	if err != nil {
+		return fmt.Errorf("get client MSP ID failed: %v", err)
+	}
+	clientID, err := ctx.GetClientIdentity().GetID()
+	if err != nil {
+		return fmt.Errorf("get client identity failed: %v", err)
+	}
+	cfg := Config{TestMode: testMode, InitializedBy: mspID + "/" + clientID}
+	if err := json.Unmarshal([]byte(adminsJSON), &cfg.Admins); err != nil {
+		return fmt.Errorf("parse adminsJSON failed: %v", err)
+	}
+	if len(cfg.Admins) == 0 {
+		return fmt.Errorf("at least one admin is required")
+	}
+	// 管理员须在 InitLedger 之前注册，否则没有公钥可用于之后的管理操作
+	for _, adminID := range cfg.Admins {
+		u, err := loadUser(ctx, adminID)
+		if err != nil {
+			return err
+		}
+		if u == nil {
+			return fmt.Errorf("admin %s is not registered", adminID)
+		}
+	}
+	if _, err := ensureSystemRolesInitialized(ctx); err != nil {
 		return fmt.Errorf("ensure roles failed: %v", err)
 	}
 
-	existing, err := ctx.GetStub().GetState(userID)
+	b, err := json.Marshal(cfg)
 	if err != nil {
-		return fmt.Errorf("get state for userID %s failed: %v", userID, err)
+		return fmt.Errorf("marshal config failed: %v", err)
 	}
-	if existing != nil {
-		return fmt.Errorf("userID %s already exists", userID)
+	if err := ctx.GetStub().PutState(configKey, b); err != nil {
+		return err
 	}
-	if _, err := parsePublicKeyPEM(publicKeyPEM); err != nil {
-		return fmt.Errorf("invalid public key: %v", err)
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventConfigChanged, Operation: "InitLedger"}); err != nil {
+		return err
 	}
-	u := User{PK: publicKeyPEM, Role: role}
-	b, err := json.Marshal(u)
-	if err != nil {
-		return fmt.Errorf("marshal user failed: %v", err)
+	if testMode {
+		log.Printf("[InitLedger] WARNING: test mode enabled by %s, AddResource accepts replayable uid-only signatures", cfg.InitializedBy)
 	}
-	return ctx.GetStub().PutState(userID, b)
+	return nil
 }
 
-func (s *SmartContract) QueryUserID(ctx contractapi.TransactionContextInterface, userID string) (*User, error) {
-	val, err := ctx.GetStub().GetState(userID)
+// SetLegacyUserIDs(proofJSON, adminID, enabled) 开关旧版 userID 模式；只影响之后的 Register，已注册用户不受影响
+func (s *SmartContract) SetLegacyUserIDs(ctx contractapi.TransactionContextInterface, proofJSON, adminID string, enabled bool) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "SetLegacyUserIDs", strconv.FormatBool(enabled)); err != nil {
+		return err
+	}
+	cfg, err := getConfig(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("get state for userID %s failed: %v", userID, err)
+		return err
 	}
-	if val == nil {
-		return nil, fmt.Errorf("userID %s does not exist", userID)
+	cfg.LegacyUserIDs = enabled
+	b, err := json.Marshal(cfg)
+	if err != nil {
+		return fmt.Errorf("marshal config failed: %v", err)
 	}
-	var u User
-	if err := json.Unmarshal(val, &u); err != nil {
-		return nil, fmt.Errorf("unmarshal user failed: %v", err)
+	if err := ctx.GetStub().PutState(configKey, b); err != nil {
+		return err
 	}
-	return &u, nil
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventConfigChanged, UID: adminID, Operation: "SetLegacyUserIDs"}); err != nil {
+		return err
+	}
+	log.Printf("[SetLegacyUserIDs] enabled=%t admin=%s", enabled, adminID)
+	return nil
 }
 
-/* ---------- AddResource ---------- */
-
-func (s *SmartContract) AddResource(
-	ctx contractapi.TransactionContextInterface,
-	signatureB64 string,
-	userID string,
-	cid string,
-) error {
-	totalStart := time.Now()
-
-	exist, err := ctx.GetStub().GetState(cid)
+// SetDefaultRole(proofJSON, adminID, role) 修改自助注册的默认角色
+func (s *SmartContract) SetDefaultRole(ctx contractapi.TransactionContextInterface, proofJSON, adminID, role string) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "SetDefaultRole", role); err != nil {
+		return err
+	}
+	roles, err := getRoleSet(ctx)
 	if err != nil {
-		return fmt.Errorf("get state for cid %s failed: %v", cid, err)
+		return err
 	}
-	if exist != nil {
-		return fmt.Errorf("resource with cid %s already exists", cid)
+	if !containsString(roles, role) {
+		return fmt.Errorf("role %q not in system roleSet", role)
 	}
-
-	u, err := s.QueryUserID(ctx, userID)
+	cfg, err := getConfig(ctx)
 	if err != nil {
 		return err
 	}
-	pub, err := parsePublicKeyPEM(u.PK)
+	cfg.DefaultRole = role
+	b, err := json.Marshal(cfg)
 	if err != nil {
-		return fmt.Errorf("parse pubkey failed: %v", err)
+		return fmt.Errorf("marshal config failed: %v", err)
 	}
-	if err := verifySignature_for_caliper(userID, signatureB64, pub); err != nil {
+	if err := ctx.GetStub().PutState(configKey, b); err != nil {
 		return err
 	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventConfigChanged, UID: adminID, Operation: "SetDefaultRole", Role: role}); err != nil {
+		return err
+	}
+	log.Printf("[SetDefaultRole] role=%s admin=%s", role, adminID)
+	return nil
+}
 
-	res := Resource{OwnerUID: userID, CID: cid, Created: time.Now().UTC()}
-	b, err := json.Marshal(res)
+// verifyAdmin 校验 adminID 在管理员列表中，且其签名凭据覆盖 fn(adminID, args...)
+func (s *SmartContract) verifyAdmin(ctx contractapi.TransactionContextInterface, proofJSON, adminID, fn string, args ...string) error {
+	cfg, err := getConfig(ctx)
 	if err != nil {
-		return fmt.Errorf("marshal resource failed: %v", err)
+		return err
 	}
-	if err := ctx.GetStub().PutState(cid, b); err != nil {
-		return fmt.Errorf("put state for cid failed: %v", err)
+	if !containsString(cfg.Admins, adminID) {
+		return fmt.Errorf("permission denied: user %s is not an admin", adminID)
 	}
-
-	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
-	log.Printf("[AddResource] cid=%s owner=%s elapsed=%.3f ms", cid, userID, elapsedMs)
-	return nil
+	_, err = s.authenticate(ctx, adminID, fn, proofJSON, append([]string{adminID}, args...)...)
+	return err
 }
 
-/* ---------- 重构后的 AddPerm (解决 MVCC 冲突) ---------- */
-
-// AddPerm(signatureB64, userID, cid, operation, rolesJSON)
-func (s *SmartContract) AddPerm(
-	ctx contractapi.TransactionContextInterface,
-	signatureB64 string,
-	userID string,
-	cid string,
-	operation string,
-	rolesJSON string,
-) error {
-	totalStart := time.Now()
+/* ---------- 动态角色管理 ---------- */
 
-	// (1) 验证属主
-	b, err := ctx.GetStub().GetState(cid)
+// AddRole(proofJSON, adminID, role) 由管理员向 roleSet 追加新角色
+func (s *SmartContract) AddRole(ctx contractapi.TransactionContextInterface, proofJSON, adminID, role string) error {
+	roles, err := ensureSystemRolesInitialized(ctx)
 	if err != nil {
-		return fmt.Errorf("get cid failed: %v", err)
+		return fmt.Errorf("ensure roles failed: %v", err)
 	}
-	if b == nil {
-		return fmt.Errorf("cid %s not found", cid)
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "AddRole", role); err != nil {
+		return err
 	}
-	var res Resource
-	if err := json.Unmarshal(b, &res); err != nil {
-		return fmt.Errorf("unmarshal resource failed: %v", err)
+	if role == "" {
+		return fmt.Errorf("role must not be empty")
 	}
-	if res.OwnerUID != userID {
-		return fmt.Errorf("permission denied: user %s is not owner of cid %s", userID, cid)
+	if containsString(roles, role) {
+		return fmt.Errorf("role %q already exists", role)
 	}
-
-	// (2) 验签
-	u, err := s.QueryUserID(ctx, userID)
-	if err != nil {
+	if err := putRoleSet(ctx, append(roles, role)); err != nil {
 		return err
 	}
-	pub, err := parsePublicKeyPEM(u.PK)
-	if err != nil {
-		return fmt.Errorf("parse pubkey failed: %v", err)
-	}
-	if err := verifySignature(userID, cid, signatureB64, pub); err != nil {
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventRoleAdded, UID: adminID, Role: role}); err != nil {
 		return err
 	}
 
-	// (3) 赋权 - 核心修改部分
-	var targetRoles []string
-	if err := json.Unmarshal([]byte(rolesJSON), &targetRoles); err != nil {
-		return fmt.Errorf("parse rolesJSON failed: %v", err)
+	log.Printf("[AddRole] role=%s admin=%s", role, adminID)
+	return nil
+}
+
+// RemoveRole(proofJSON, adminID, role) 删除角色；角色仍被用户持有、仍有授权或仍被拒绝规则引用时拒绝
+// 否则同名角色重新创建后会继承旧的授权与拒绝规则
+func (s *SmartContract) RemoveRole(ctx contractapi.TransactionContextInterface, proofJSON, adminID, role string) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "RemoveRole", role); err != nil {
+		return err
 	}
 
+	roles, err := getRoleSet(ctx)
+	if err != nil {
+		return err
+	}
+	if !containsString(roles, role) {
+		return fmt.Errorf("role %q not in system roleSet", role)
+	}
+	// 删除默认角色后所有自助注册都会失败，须先用 SetDefaultRole 换成其他角色
+	cfg, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if role == cfg.selfRegisterRole() {
+		return fmt.Errorf("role %q is the default self-registration role; change it with SetDefaultRole first", role)
+	}
+
+	// 旧版升级的账本上，未迁移的用户持有的角色不在 role~uid 索引中，索引不完整时不能据此删除角色
+	indexed, err := ctx.GetStub().GetState(roleIndexKey)
+	if err != nil {
+		return fmt.Errorf("get role index state failed: %v", err)
+	}
+	if indexed == nil {
+		return fmt.Errorf("role~uid index is incomplete on this upgraded ledger; run BackfillRoleIndex for all existing users first")
+	}
+	inUse, err := hasPartialCompositeKey(ctx, roleUserObjType, []string{role})
+	if err != nil {
+		return err
+	}
+	if inUse {
+		return fmt.Errorf("role %q is still assigned to users", role)
+	}
+	granted, err := hasPartialCompositeKey(ctx, policyObjType, []string{role})
+	if err != nil {
+		return err
+	}
+	if granted {
+		return fmt.Errorf("role %q still has policy entries", role)
+	}
+	edges, err := listRoleEdges(ctx)
+	if err != nil {
+		return err
+	}
+	for _, e := range edges {
+		if e.Senior == role || e.Junior == role {
+			return fmt.Errorf("role %q is still part of inheritance edge %s -> %s", role, e.Senior, e.Junior)
+		}
+	}
+	denied, err := hasDenyRuleForSubject(ctx, denySubjectRole+role)
+	if err != nil {
+		return err
+	}
+	if denied {
+		return fmt.Errorf("role %q is still the subject of deny rules", role)
+	}
+
+	remaining := make([]string, 0, len(roles)-1)
+	for _, r := range roles {
+		if r != role {
+			remaining = append(remaining, r)
+		}
+	}
+	if err := putRoleSet(ctx, remaining); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventRoleRemoved, UID: adminID, Role: role}); err != nil {
+		return err
+	}
+
+	log.Printf("[RemoveRole] role=%s admin=%s", role, adminID)
+	return nil
+}
+
+// BackfillRoleIndex(proofJSON, adminID, userIDsJSON, complete) 为旧版用户补写 role~uid 索引，并把记录改写为多角色格式
+// 旧版用户数量可能很多，可分批调用；complete 为 true 表示全部旧用户已迁移，此后 RemoveRole 才可执行
+func (s *SmartContract) BackfillRoleIndex(ctx contractapi.TransactionContextInterface, proofJSON, adminID, userIDsJSON string, complete bool) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "BackfillRoleIndex", userIDsJSON, strconv.FormatBool(complete)); err != nil {
+		return err
+	}
+	var userIDs []string
+	if err := json.Unmarshal([]byte(userIDsJSON), &userIDs); err != nil {
+		return fmt.Errorf("parse userIDsJSON failed: %v", err)
+	}
+	if len(userIDs) > batchMaxSize {
+		return fmt.Errorf("user count must not exceed %d", batchMaxSize)
+	}
+	for _, userID := range userIDs {
+		u, err := s.QueryUserID(ctx, userID)
+		if err != nil {
+			return err
+		}
+		// putUser 按新格式改写旧版记录并补写索引，已是新格式的用户原样写回
+		if err := putUser(ctx, userID, u); err != nil {
+			return err
+		}
+	}
+	if complete {
+		if err := ctx.GetStub().PutState(roleIndexKey, []byte{0x01}); err != nil {
+			return err
+		}
+	}
+
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventRoleIndexBackfilled, UID: adminID, UIDs: userIDs}); err != nil {
+		return err
+	}
+	log.Printf("[BackfillRoleIndex] users=%d complete=%t admin=%s", len(userIDs), complete, adminID)
+	return nil
+}
+
+// ListRoles 返回当前生效的角色集合；尚未初始化时返回默认角色
+func (s *SmartContract) ListRoles(ctx contractapi.TransactionContextInterface) ([]string, error) {
+	roles, err := getRoleSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if roles == nil {
+		return defaultSystemRoles, nil
+	}
+	return roles, nil
+}
+
+/* ---------- 角色继承 (DAG) ---------- */
+
+func putRoleEdge(ctx contractapi.TransactionContextInterface, senior, junior string) error {
+	edgeKey, err := ctx.GetStub().CreateCompositeKey(roleEdgeObjType, []string{senior, junior})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	return ctx.GetStub().PutState(edgeKey, []byte{0x01})
+}
+
+// getJuniorRoles 返回 role 直接继承的下级角色
+func getJuniorRoles(ctx contractapi.TransactionContextInterface, role string) ([]string, error) {
+	it, err := ctx.GetStub().GetStateByPartialCompositeKey(roleEdgeObjType, []string{role})
+	if err != nil {
+		return nil, fmt.Errorf("get role edges failed: %v", err)
+	}
+	defer it.Close()
+
+	var juniors []string
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attrs, err := ctx.GetStub().SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("split composite key failed: %v", err)
+		}
+		juniors = append(juniors, attrs[1])
+	}
+	return juniors, nil
+}
+
+func listRoleEdges(ctx contractapi.TransactionContextInterface) ([]RoleEdge, error) {
+	it, err := ctx.GetStub().GetStateByPartialCompositeKey(roleEdgeObjType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("get role edges failed: %v", err)
+	}
+	defer it.Close()
+
+	var edges []RoleEdge
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attrs, err := ctx.GetStub().SplitCompositeKey(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("split composite key failed: %v", err)
+		}
+		edges = append(edges, RoleEdge{Senior: attrs[0], Junior: attrs[1]})
+	}
+	return edges, nil
+}
+
+// effectiveRoles 从 role 出发广度优先遍历继承图，返回 role 本身及其全部下级角色
+// 顺序为由近及远，CheckPerm 据此优先命中直接授权
+func effectiveRoles(ctx contractapi.TransactionContextInterface, role string) ([]string, error) {
+	visited := map[string]bool{role: true}
+	order := []string{role}
+	for i := 0; i < len(order); i++ {
+		juniors, err := getJuniorRoles(ctx, order[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, j := range juniors {
+			if !visited[j] {
+				visited[j] = true
+				order = append(order, j)
+			}
+		}
+	}
+	return order, nil
+}
+
+// AddRoleInheritance(proofJSON, adminID, senior, junior) 添加继承边，拒绝会成环的边
+func (s *SmartContract) AddRoleInheritance(ctx contractapi.TransactionContextInterface, proofJSON, adminID, senior, junior string) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "AddRoleInheritance", senior, junior); err != nil {
+		return err
+	}
+	if senior == junior {
+		return fmt.Errorf("role %q cannot inherit itself", senior)
+	}
+
+	roles, err := getRoleSet(ctx)
+	if err != nil {
+		return err
+	}
+	for _, r := range []string{senior, junior} {
+		if !containsString(roles, r) {
+			return fmt.Errorf("role %q not in system roleSet", r)
+		}
+	}
+
+	// 若 senior 已是 junior 的下级，则新边会形成环
+	reachable, err := effectiveRoles(ctx, junior)
+	if err != nil {
+		return err
+	}
+	if containsString(reachable, senior) {
+		return fmt.Errorf("edge %s -> %s would create a cycle", senior, junior)
+	}
+
+	if err := putRoleEdge(ctx, senior, junior); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventRoleInheritanceAdded, UID: adminID, Role: senior, Target: junior}); err != nil {
+		return err
+	}
+	log.Printf("[AddRoleInheritance] %s -> %s admin=%s", senior, junior, adminID)
+	return nil
+}
+
+// RemoveRoleInheritance(proofJSON, adminID, senior, junior) 删除继承边
+func (s *SmartContract) RemoveRoleInheritance(ctx contractapi.TransactionContextInterface, proofJSON, adminID, senior, junior string) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "RemoveRoleInheritance", senior, junior); err != nil {
+		return err
+	}
+	edgeKey, err := ctx.GetStub().CreateCompositeKey(roleEdgeObjType, []string{senior, junior})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	val, err := ctx.GetStub().GetState(edgeKey)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return fmt.Errorf("edge %s -> %s not found", senior, junior)
+	}
+	if err := ctx.GetStub().DelState(edgeKey); err != nil {
+		return fmt.Errorf("delete role edge failed: %v", err)
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventRoleInheritanceRemoved, UID: adminID, Role: senior, Target: junior}); err != nil {
+		return err
+	}
+	log.Printf("[RemoveRoleInheritance] %s -> %s admin=%s", senior, junior, adminID)
+	return nil
+}
+
+func (s *SmartContract) ListRoleInheritance(ctx contractapi.TransactionContextInterface) ([]RoleEdge, error) {
+	return listRoleEdges(ctx)
+}
+
+/* ---------- 新增：基于组合键的权限管理工具 ---------- */
+
+// putPolicyEntry 使用组合键写入权限
+// Key 结构: policy + role + cid + operation
+// 优势: 不同的 (role, cid) 组合会生成完全不同的 Key，互不冲突
+func putPolicyEntry(ctx contractapi.TransactionContextInterface, role, cid, operation string, grant *PolicyGrant) error {
+	// 创建组合键: indexName="policy", attributes=[role, cid, operation]
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(policyObjType, []string{role, cid, operation})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+
+	// Key 的存在即代表有权限，值中只保存可选的有效期
+	// 这是一个 Blind Write (盲写)，不需要先 Read，彻底消除 MVCC 读写冲突
+	val, err := json.Marshal(grant)
+	if err != nil {
+		return fmt.Errorf("marshal policy grant failed: %v", err)
+	}
+	return ctx.GetStub().PutState(compositeKey, val)
+}
+
+// getPolicyEntry 读取权限，不存在时返回 nil
+func getPolicyEntry(ctx contractapi.TransactionContextInterface, role, cid, operation string) (*PolicyGrant, error) {
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(policyObjType, []string{role, cid, operation})
+	if err != nil {
+		return nil, fmt.Errorf("create composite key failed: %v", err)
+	}
+
+	val, err := ctx.GetStub().GetState(compositeKey)
+	if err != nil {
+		return nil, err
+	}
+	return decodePolicyGrant(val)
+}
+
+// decodePolicyGrant 解析 policy 值，兼容旧版的 0x01 标记
+func decodePolicyGrant(val []byte) (*PolicyGrant, error) {
+	if val == nil {
+		return nil, nil
+	}
+	var grant PolicyGrant
+	if len(val) == 1 && val[0] == 0x01 {
+		return &grant, nil
+	}
+	if err := json.Unmarshal(val, &grant); err != nil {
+		return nil, fmt.Errorf("unmarshal policy grant failed: %v", err)
+	}
+	return &grant, nil
+}
+
+// parseGrantWindow 解析 AddPerm 的 notBefore/notAfter (RFC3339)，空串表示不限
+func parseGrantWindow(notBefore, notAfter string) (*PolicyGrant, error) {
+	var grant PolicyGrant
+	if notBefore != "" {
+		t, err := time.Parse(time.RFC3339, notBefore)
+		if err != nil {
+			return nil, fmt.Errorf("parse notBefore failed: %v", err)
+		}
+		t = t.UTC()
+		grant.NotBefore = &t
+	}
+	if notAfter != "" {
+		t, err := time.Parse(time.RFC3339, notAfter)
+		if err != nil {
+			return nil, fmt.Errorf("parse notAfter failed: %v", err)
+		}
+		t = t.UTC()
+		grant.NotAfter = &t
+	}
+	if grant.NotBefore != nil && grant.NotAfter != nil && !grant.NotBefore.Before(*grant.NotAfter) {
+		return nil, fmt.Errorf("notBefore must be earlier than notAfter")
+	}
+	return &grant, nil
+}
+
+// deletePolicyEntry 删除组合键对应的权限，返回该权限此前是否存在
+func deletePolicyEntry(ctx contractapi.TransactionContextInterface, role, cid, operation string) (bool, error) {
+	compositeKey, err := ctx.GetStub().CreateCompositeKey(policyObjType, []string{role, cid, operation})
+	if err != nil {
+		return false, fmt.Errorf("create composite key failed: %v", err)
+	}
+
+	val, err := ctx.GetStub().GetState(compositeKey)
+	if err != nil {
+		return false, err
+	}
+	if val == nil {
+		return false, nil
+	}
+	if err := ctx.GetStub().DelState(compositeKey); err != nil {
+		return false, fmt.Errorf("delete policy entry failed: %v", err)
+	}
+	return true, nil
+}
+
+/* ---------- 用户注册与查询 ---------- */
+
+// Register(userID, publicKeyPEM, role) 自助注册：只能取得默认角色 (Config.DefaultRole)，
+// 除非提交交易的 Fabric 客户端证书带有 registrarAttr=true 属性
+func (s *SmartContract) Register(ctx contractapi.TransactionContextInterface, userID, publicKeyPEM, role string) error {
+	cfg, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if role != cfg.selfRegisterRole() && !hasRegistrarAttr(ctx) {
+		return fmt.Errorf("permission denied: role %q requires AdminRegister or the %s client attribute", role, registrarAttr)
+	}
+	return registerUser(ctx, cfg, userID, publicKeyPEM, role)
+}
+
+// hasRegistrarAttr 判断提交者的 Fabric 客户端证书 (Fabric CA 签发的属性扩展) 是否带有 registrarAttr=true
+func hasRegistrarAttr(ctx contractapi.TransactionContextInterface) bool {
+	return ctx.GetClientIdentity().AssertAttributeValue(registrarAttr, "true") == nil
+}
+
+// AdminRegister(proofJSON, adminID, userID, publicKeyPEM, role) 由管理员签名为用户注册任意角色
+func (s *SmartContract) AdminRegister(ctx contractapi.TransactionContextInterface, proofJSON, adminID, userID, publicKeyPEM, role string) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "AdminRegister", userID, publicKeyPEM, role); err != nil {
+		return err
+	}
+	cfg, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	if err := registerUser(ctx, cfg, userID, publicKeyPEM, role); err != nil {
+		return err
+	}
+	log.Printf("[AdminRegister] uid=%s role=%s admin=%s", userID, role, adminID)
+	return nil
+}
+
+func registerUser(ctx contractapi.TransactionContextInterface, cfg *Config, userID, publicKeyPEM, role string) error {
+	roles, err := ensureSystemRolesInitialized(ctx)
+	if err != nil {
+		return fmt.Errorf("ensure roles failed: %v", err)
+	}
+
+	if err := validatePlainKey("userID", userID); err != nil {
+		return err
+	}
+	existing, err := ctx.GetStub().GetState(userID)
+	if err != nil {
+		return fmt.Errorf("get state for userID %s failed: %v", userID, err)
+	}
+	if existing != nil {
+		return fmt.Errorf("userID %s already exists", userID)
+	}
+	pub, err := parsePublicKeyPEM(publicKeyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	// userID 须为公钥 DER (SPKI) 的 SHA-256，防止抢注他人的 ID；PEM 文本可随意附加内容，不能作为哈希输入
+	if !cfg.LegacyUserIDs {
+		fp, err := keyFingerprint(pub)
+		if err != nil {
+			return err
+		}
+		if userID != fp {
+			return fmt.Errorf("userID %s does not match public key hash %s", userID, fp)
+		}
+	}
+	if !containsString(roles, role) {
+		return fmt.Errorf("role %q not in system roleSet", role)
+	}
+
+	u := User{PK: publicKeyPEM, KeyAlg: keyAlgorithm(pub), Roles: []string{role}}
+	if err := putUser(ctx, userID, &u); err != nil {
+		return err
+	}
+	if err := putRoleUserIndex(ctx, role, userID); err != nil {
+		return err
+	}
+	return emitEvent(ctx, ChaincodeEvent{Type: eventUserRegistered, UID: userID, Role: role})
+}
+
+// putUser 写入用户记录；旧版记录在第一次改写时一并补写其全部角色的 role~uid 索引
+func putUser(ctx contractapi.TransactionContextInterface, userID string, u *User) error {
+	b, err := json.Marshal(u)
+	if err != nil {
+		return fmt.Errorf("marshal user failed: %v", err)
+	}
+	if err := ctx.GetStub().PutState(userID, b); err != nil {
+		return err
+	}
+	if u.legacy {
+		for _, role := range u.Roles {
+			if err := putRoleUserIndex(ctx, role, userID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// putRoleUserIndex 写入 role~uid 反向索引
+func putRoleUserIndex(ctx contractapi.TransactionContextInterface, role, userID string) error {
+	indexKey, err := ctx.GetStub().CreateCompositeKey(roleUserObjType, []string{role, userID})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	return ctx.GetStub().PutState(indexKey, []byte{0x00})
+}
+
+func deleteRoleUserIndex(ctx contractapi.TransactionContextInterface, role, userID string) error {
+	indexKey, err := ctx.GetStub().CreateCompositeKey(roleUserObjType, []string{role, userID})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	return ctx.GetStub().DelState(indexKey)
+}
+
+// AssignRole(proofJSON, adminID, userID, role) 由管理员为用户追加角色
+func (s *SmartContract) AssignRole(ctx contractapi.TransactionContextInterface, proofJSON, adminID, userID, role string) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "AssignRole", userID, role); err != nil {
+		return err
+	}
+	roles, err := getRoleSet(ctx)
+	if err != nil {
+		return err
+	}
+	if !containsString(roles, role) {
+		return fmt.Errorf("role %q not in system roleSet", role)
+	}
+
+	u, err := s.QueryUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if containsString(u.Roles, role) {
+		return fmt.Errorf("user %s already holds role %q", userID, role)
+	}
+	u.Roles = append(u.Roles, role)
+	if err := putUser(ctx, userID, u); err != nil {
+		return err
+	}
+	if err := putRoleUserIndex(ctx, role, userID); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventRoleAssigned, UID: adminID, Target: userID, Role: role}); err != nil {
+		return err
+	}
+
+	log.Printf("[AssignRole] uid=%s role=%s admin=%s", userID, role, adminID)
+	return nil
+}
+
+// UnassignRole(proofJSON, adminID, userID, role) 由管理员收回用户的某个角色
+func (s *SmartContract) UnassignRole(ctx contractapi.TransactionContextInterface, proofJSON, adminID, userID, role string) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, "UnassignRole", userID, role); err != nil {
+		return err
+	}
+
+	u, err := s.QueryUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if !containsString(u.Roles, role) {
+		return fmt.Errorf("user %s does not hold role %q", userID, role)
+	}
+	remaining := make([]string, 0, len(u.Roles)-1)
+	for _, r := range u.Roles {
+		if r != role {
+			remaining = append(remaining, r)
+		}
+	}
+	u.Roles = remaining
+	if err := putUser(ctx, userID, u); err != nil {
+		return err
+	}
+	if err := deleteRoleUserIndex(ctx, role, userID); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventRoleUnassigned, UID: adminID, Target: userID, Role: role}); err != nil {
+		return err
+	}
+
+	log.Printf("[UnassignRole] uid=%s role=%s admin=%s", userID, role, adminID)
+	return nil
+}
+
+func (s *SmartContract) QueryUserID(ctx contractapi.TransactionContextInterface, userID string) (*User, error) {
+	u, err := loadUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if u == nil {
+		return nil, fmt.Errorf("userID %s does not exist", userID)
+	}
+	return u, nil
+}
+
+// loadUser 读取用户并兼容旧版记录，用户不存在时返回 nil
+// cid 与 userID 共用同一键空间，没有公钥的记录 (资源等) 不是用户，同样返回 nil
+func loadUser(ctx contractapi.TransactionContextInterface, userID string) (*User, error) {
+	val, err := ctx.GetStub().GetState(userID)
+	if err != nil {
+		return nil, fmt.Errorf("get state for userID %s failed: %v", userID, err)
+	}
+	if val == nil {
+		return nil, nil
+	}
+	var u User
+	if err := json.Unmarshal(val, &u); err != nil {
+		return nil, fmt.Errorf("unmarshal user failed: %v", err)
+	}
+	if u.PK == "" {
+		return nil, nil
+	}
+	// 兼容旧版单角色记录
+	if u.Role != "" {
+		u.legacy = true
+		if !containsString(u.Roles, u.Role) {
+			u.Roles = append([]string{u.Role}, u.Roles...)
+		}
+		u.Role = ""
+	}
+	if u.Roles == nil {
+		u.Roles = []string{}
+	}
+	// 旧版记录只可能是 RSA 公钥
+	if u.KeyAlg == "" {
+		u.KeyAlg = keyAlgRSA
+	}
+	return &u, nil
+}
+
+/* ---------- 密钥轮换与用户状态 ---------- */
+
+const (
+	userStatusSuspended = "suspended"
+	userStatusRevoked   = "revoked"
+)
+
+// checkUserActive 拒绝被停用或吊销的用户发起签名交易
+func checkUserActive(userID string, u *User) error {
+	if u.Status != "" {
+		return fmt.Errorf("permission denied: user %s is %s", userID, u.Status)
+	}
+	return nil
+}
+
+// RotateKey(oldProofJSON, newProofJSON, userID, newPK) 更换用户公钥，userID 与角色保持不变
+// 两份凭据都须覆盖 RotateKey(userID, newPK)：旧凭据由当前私钥签名证明持有者身份，新凭据由新私钥签名证明持有新私钥
+func (s *SmartContract) RotateKey(ctx contractapi.TransactionContextInterface, oldProofJSON, newProofJSON, userID, newPK string) error {
+	u, err := s.authenticate(ctx, userID, "RotateKey", oldProofJSON, userID, newPK)
+	if err != nil {
+		return fmt.Errorf("old key: %v", err)
+	}
+	newPub, err := parsePublicKeyPEM(newPK)
+	if err != nil {
+		return fmt.Errorf("invalid public key: %v", err)
+	}
+	oldPub, err := parsePublicKeyPEM(u.PK)
+	if err != nil {
+		return fmt.Errorf("parse pubkey failed: %v", err)
+	}
+	oldFP, err := keyFingerprint(oldPub)
+	if err != nil {
+		return err
+	}
+	newFP, err := keyFingerprint(newPub)
+	if err != nil {
+		return err
+	}
+	if newFP == oldFP {
+		return fmt.Errorf("new key is identical to the current key")
+	}
+	for _, k := range u.PrevKeys {
+		if k.Fingerprint == newFP {
+			return fmt.Errorf("new key was already used by user %s", userID)
+		}
+	}
+	if err := verifyProof(ctx, userID, newPub, "RotateKey", newProofJSON, userID, newPK); err != nil {
+		return fmt.Errorf("new key: %v", err)
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	u.PrevKeys = append(u.PrevKeys, RetiredKey{Fingerprint: oldFP, KeyAlg: u.KeyAlg, RetiredAt: now})
+	u.PK = newPK
+	u.KeyAlg = keyAlgorithm(newPub)
+	if err := putUser(ctx, userID, u); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventKeyRotated, UID: userID}); err != nil {
+		return err
+	}
+
+	log.Printf("[RotateKey] uid=%s alg=%s prevKeys=%d", userID, u.KeyAlg, len(u.PrevKeys))
+	return nil
+}
+
+// SuspendUser(proofJSON, adminID, userID) 暂停用户：其签名交易被拒绝，CheckPerm 以 user_suspended 拒绝
+func (s *SmartContract) SuspendUser(ctx contractapi.TransactionContextInterface, proofJSON, adminID, userID string) error {
+	return s.setUserStatus(ctx, proofJSON, adminID, "SuspendUser", userID, userStatusSuspended)
+}
+
+// ReinstateUser(proofJSON, adminID, userID) 恢复被暂停的用户；已吊销的用户不可恢复
+func (s *SmartContract) ReinstateUser(ctx contractapi.TransactionContextInterface, proofJSON, adminID, userID string) error {
+	return s.setUserStatus(ctx, proofJSON, adminID, "ReinstateUser", userID, "")
+}
+
+// RevokeUser(proofJSON, adminID, userID) 永久吊销用户，用于私钥泄露且无法轮换的情况
+func (s *SmartContract) RevokeUser(ctx contractapi.TransactionContextInterface, proofJSON, adminID, userID string) error {
+	return s.setUserStatus(ctx, proofJSON, adminID, "RevokeUser", userID, userStatusRevoked)
+}
+
+func (s *SmartContract) setUserStatus(ctx contractapi.TransactionContextInterface, proofJSON, adminID, fn, userID, status string) error {
+	if err := s.verifyAdmin(ctx, proofJSON, adminID, fn, userID); err != nil {
+		return err
+	}
+	if adminID == userID {
+		return fmt.Errorf("admin %s cannot change own status", adminID)
+	}
+	u, err := s.QueryUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if u.Status == userStatusRevoked {
+		return fmt.Errorf("user %s is revoked", userID)
+	}
+	if u.Status == status {
+		return fmt.Errorf("user %s already has status %q", userID, status)
+	}
+	u.Status = status
+	if err := putUser(ctx, userID, u); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventUserStatusChanged, UID: adminID, Target: userID, Reason: status}); err != nil {
+		return err
+	}
+
+	log.Printf("[%s] uid=%s status=%q admin=%s", fn, userID, status, adminID)
+	return nil
+}
+
+/* ---------- libp2p 节点绑定 ---------- */
+
+// PeerBinding 记录 libp2p 节点 ID 与链上用户的一一对应关系
+type PeerBinding struct {
+	PeerID  string    `json:"peerID"`
+	UserID  string    `json:"userID"`
+	BoundAt time.Time `json:"boundAt"`
+	// Status 为绑定用户的当前状态，由 QueryUserByPeer 查询时填充，不随绑定写入
+	Status string `json:"status,omitempty" metadata:",optional"`
+}
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// decodeBase58 解码 base58btc (比特币字母表)
+func decodeBase58(str string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for _, c := range str {
+		i := strings.IndexRune(base58Alphabet, c)
+		if i < 0 {
+			return nil, fmt.Errorf("invalid base58 character %q", c)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	// 每个前导 '1' 对应一个前导零字节
+	zeros := 0
+	for zeros < len(str) && str[zeros] == '1' {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// readUvarint 读取 unsigned varint，返回值与消耗的字节数
+func readUvarint(b []byte) (uint64, int, error) {
+	var v uint64
+	for i := 0; i < len(b) && i < 10; i++ {
+		v |= uint64(b[i]&0x7f) << (7 * uint(i))
+		if b[i] < 0x80 {
+			return v, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid varint")
+}
+
+const (
+	multihashIdentity = 0x00
+	multihashSHA256   = 0x12
+)
+
+// parsePeerID 将 base58btc 形式的 peer ID (Qm... / 12D3KooW...) 拆为 multihash 类型与摘要
+func parsePeerID(peerID string) (uint64, []byte, error) {
+	mh, err := decodeBase58(peerID)
+	if err != nil {
+		return 0, nil, fmt.Errorf("decode peer ID failed: %v", err)
+	}
+	code, n, err := readUvarint(mh)
+	if err != nil {
+		return 0, nil, fmt.Errorf("decode peer ID failed: %v", err)
+	}
+	length, m, err := readUvarint(mh[n:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("decode peer ID failed: %v", err)
+	}
+	digest := mh[n+m:]
+	if uint64(len(digest)) != length {
+		return 0, nil, fmt.Errorf("peer ID multihash length mismatch")
+	}
+	switch code {
+	case multihashIdentity:
+	case multihashSHA256:
+		if length != sha256.Size {
+			return 0, nil, fmt.Errorf("peer ID sha2-256 digest must be %d bytes", sha256.Size)
+		}
+	default:
+		return 0, nil, fmt.Errorf("unsupported peer ID multihash 0x%x", code)
+	}
+	return code, digest, nil
+}
+
+// libp2p crypto.pb 中的 KeyType
+const (
+	libp2pKeyRSA     = 0
+	libp2pKeyEd25519 = 1
+	libp2pKeyECDSA   = 3
+)
+
+// parseLibp2pPublicKey 解析 libp2p 的 protobuf 公钥 (Type = 1, Data = 2)
+// RSA 与 ECDSA 的 Data 为 PKIX DER，Ed25519 为 32 字节原始公钥；secp256k1 不支持
+func parseLibp2pPublicKey(b []byte) (crypto.PublicKey, error) {
+	var keyType uint64
+	var data []byte
+	for len(b) > 0 {
+		tag, n, err := readUvarint(b)
+		if err != nil {
+			return nil, err
+		}
+		b = b[n:]
+		switch tag {
+		case 0x08: // field 1, varint
+			v, n, err := readUvarint(b)
+			if err != nil {
+				return nil, err
+			}
+			keyType, b = v, b[n:]
+		case 0x12: // field 2, length-delimited
+			l, n, err := readUvarint(b)
+			if err != nil {
+				return nil, err
+			}
+			if uint64(len(b)-n) < l {
+				return nil, fmt.Errorf("truncated public key data")
+			}
+			data, b = b[n:n+int(l)], b[n+int(l):]
+		default:
+			return nil, fmt.Errorf("unexpected public key field tag 0x%x", tag)
+		}
+	}
+	if data == nil {
+		return nil, fmt.Errorf("public key data missing")
+	}
+
+	switch keyType {
+	case libp2pKeyEd25519:
+		if len(data) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("ed25519 public key must be %d bytes", ed25519.PublicKeySize)
+		}
+		return ed25519.PublicKey(data), nil
+	case libp2pKeyRSA, libp2pKeyECDSA:
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("parse public key failed: %v", err)
+		}
+		if keyAlgorithm(pub) == "" {
+			return nil, fmt.Errorf("unsupported public key type %T", pub)
+		}
+		return pub, nil
+	default:
+		return nil, fmt.Errorf("unsupported libp2p key type %d", keyType)
+	}
+}
+
+// peerPublicKey 取得 peerID 对应的公钥：identity multihash 直接内嵌公钥，sha2-256 须由调用方提供
+// peerKeyB64 为 base64 编码的 libp2p protobuf 公钥，identity 形式可传空串
+func peerPublicKey(peerID, peerKeyB64 string) (crypto.PublicKey, error) {
+	code, digest, err := parsePeerID(peerID)
+	if err != nil {
+		return nil, err
+	}
+	keyBytes := digest
+	if code == multihashSHA256 || peerKeyB64 != "" {
+		if keyBytes, err = base64.StdEncoding.DecodeString(peerKeyB64); err != nil {
+			return nil, fmt.Errorf("decode peer key failed: %v", err)
+		}
+	}
+	switch code {
+	case multihashIdentity:
+		if string(keyBytes) != string(digest) {
+			return nil, fmt.Errorf("peer key does not match peer ID %s", peerID)
+		}
+	case multihashSHA256:
+		sum := sha256.Sum256(keyBytes)
+		if string(sum[:]) != string(digest) {
+			return nil, fmt.Errorf("peer key does not match peer ID %s", peerID)
+		}
+	}
+	return parseLibp2pPublicKey(keyBytes)
+}
+
+// BindPeer(proofJSON, peerSig, userID, peerID, peerKey) 将 libp2p 节点绑定到用户，双方都须签名同意
+// proofJSON 为用户对 BindPeer(userID, peerID, peerKey) 的常规凭据；peerSig 为节点私钥对同一 payload
+// (使用凭据中的 nonce 与 expiry) 的 base64 签名，签名方式与 libp2p 的 PrivKey.Sign 一致
+// 一个 peerID 只能绑定一个用户；用户重新绑定时旧 peerID 自动解绑
+func (s *SmartContract) BindPeer(ctx contractapi.TransactionContextInterface, proofJSON, peerSig, userID, peerID, peerKey string) error {
+	peerPub, err := peerPublicKey(peerID, peerKey)
+	if err != nil {
+		return err
+	}
+	u, err := s.authenticate(ctx, userID, "BindPeer", proofJSON, userID, peerID, peerKey)
+	if err != nil {
+		return err
+	}
+	var proof SignedProof
+	if err := json.Unmarshal([]byte(proofJSON), &proof); err != nil {
+		return fmt.Errorf("parse signed proof failed: %v", err)
+	}
+	payload := canonicalPayload("BindPeer", []string{userID, peerID, peerKey}, proof.Nonce, proof.Expiry)
+	if err := verifyPayloadSignature(payload, peerSig, peerPub); err != nil {
+		return fmt.Errorf("peer signature: %v", err)
+	}
+
+	existing, err := getPeerBinding(ctx, peerID)
+	if err != nil {
+		return err
+	}
+	if existing != nil && existing.UserID != userID {
+		return fmt.Errorf("peer %s is already bound to another user", peerID)
+	}
+	if u.PeerID != "" && u.PeerID != peerID {
+		oldKey, err := ctx.GetStub().CreateCompositeKey(peerUserObjType, []string{u.PeerID})
+		if err != nil {
+			return fmt.Errorf("create composite key failed: %v", err)
+		}
+		if err := ctx.GetStub().DelState(oldKey); err != nil {
+			return fmt.Errorf("delete peer binding failed: %v", err)
+		}
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	key, err := ctx.GetStub().CreateCompositeKey(peerUserObjType, []string{peerID})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	b, err := json.Marshal(PeerBinding{PeerID: peerID, UserID: userID, BoundAt: now})
+	if err != nil {
+		return fmt.Errorf("marshal peer binding failed: %v", err)
+	}
+	if err := ctx.GetStub().PutState(key, b); err != nil {
+		return err
+	}
+	u.PeerID = peerID
+	if err := putUser(ctx, userID, u); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventPeerBound, UID: userID, Target: peerID}); err != nil {
+		return err
+	}
+
+	log.Printf("[BindPeer] uid=%s peer=%s", userID, peerID)
+	return nil
+}
+
+func getPeerBinding(ctx contractapi.TransactionContextInterface, peerID string) (*PeerBinding, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(peerUserObjType, []string{peerID})
+	if err != nil {
+		return nil, fmt.Errorf("create composite key failed: %v", err)
+	}
+	b, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("get peer binding failed: %v", err)
+	}
+	if b == nil {
+		return nil, nil
+	}
+	var binding PeerBinding
+	if err := json.Unmarshal(b, &binding); err != nil {
+		return nil, fmt.Errorf("unmarshal peer binding failed: %v", err)
+	}
+	return &binding, nil
+}
+
+// QueryUserByPeer(peerID) 解析 libp2p 节点 ID 对应的用户，供 bitswap 按 p.String() 查询
+// 已吊销用户的节点不再解析；被暂停的用户照常解析，Status 为 userStatusSuspended，由调用方决定是否放行
+func (s *SmartContract) QueryUserByPeer(ctx contractapi.TransactionContextInterface, peerID string) (*PeerBinding, error) {
+	binding, err := getPeerBinding(ctx, peerID)
+	if err != nil {
+		return nil, err
+	}
+	if binding == nil {
+		return nil, fmt.Errorf("peer %s is not bound to any user", peerID)
+	}
+	u, err := s.QueryUserID(ctx, binding.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if u.Status == userStatusRevoked {
+		return nil, fmt.Errorf("peer %s is bound to revoked user %s", peerID, binding.UserID)
+	}
+	binding.Status = u.Status
+	return binding, nil
+}
+
+/* ---------- AddResource ---------- */
+
+// AddResource(proofJSON, userID, cid)
+// 测试模式下 proofJSON 也可以是只覆盖 uid 的 base64 静态签名，便于 Caliper 预计算
+func (s *SmartContract) AddResource(
+	ctx contractapi.TransactionContextInterface,
+	proofJSON string,
+	userID string,
+	cid string,
+) error {
+	totalStart := time.Now()
+
+	if err := checkResourceAbsent(ctx, cid); err != nil {
+		return err
+	}
+
+	u, err := s.QueryUserID(ctx, userID)
+	if err != nil {
+		return err
+	}
+	if err := checkUserActive(userID, u); err != nil {
+		return err
+	}
+	pub, err := parsePublicKeyPEM(u.PK)
+	if err != nil {
+		return fmt.Errorf("parse pubkey failed: %v", err)
+	}
+	cfg, err := getConfig(ctx)
+	if err != nil {
+		return err
+	}
+	// 签名凭据是 JSON 对象，base64 静态签名不会以 '{' 开头
+	if cfg.TestMode && !strings.HasPrefix(strings.TrimSpace(proofJSON), "{") {
+		if err := verifyPayloadSignature([]byte(userID), proofJSON, pub); err != nil {
+			return err
+		}
+	} else if err := verifyProof(ctx, userID, pub, "AddResource", proofJSON, userID, cid); err != nil {
+		return err
+	}
+
+	// 使用交易时间戳而非本地时钟，否则各背书节点写集不一致导致背书失败
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if err := putResource(ctx, &Resource{OwnerUID: userID, CID: cid, Created: now}); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventResourceAdded, UID: userID, CID: cid}); err != nil {
+		return err
+	}
+
+	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
+	log.Printf("[AddResource] cid=%s owner=%s elapsed=%.3f ms", cid, userID, elapsedMs)
+	return nil
+}
+
+func getResource(ctx contractapi.TransactionContextInterface, cid string) (*Resource, error) {
+	b, err := ctx.GetStub().GetState(cid)
+	if err != nil {
+		return nil, fmt.Errorf("get cid failed: %v", err)
+	}
+	if b == nil {
+		return nil, fmt.Errorf("cid %s not found", cid)
+	}
+	var res Resource
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, fmt.Errorf("unmarshal resource failed: %v", err)
+	}
+	return &res, nil
+}
+
+// getActiveResource 与 getResource 相同，但拒绝已删除的资源
+func getActiveResource(ctx contractapi.TransactionContextInterface, cid string) (*Resource, error) {
+	res, err := getResource(ctx, cid)
+	if err != nil {
+		return nil, err
+	}
+	if res.Tombstone != nil {
+		return nil, fmt.Errorf("cid %s has been removed", cid)
+	}
+	return res, nil
+}
+
+// isUserIDShaped 判断 s 是否为 64 位十六进制串，即 keyFingerprint 的输出格式
+func isUserIDShaped(s string) bool {
+	if len(s) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// checkResourceAbsent 要求 cid 合法且从未注册过；墓碑化的 cid 同样视为已存在
+func checkResourceAbsent(ctx contractapi.TransactionContextInterface, cid string) error {
+	if err := validatePlainKey("cid", cid); err != nil {
+		return err
+	}
+	// 形如 userID 的 cid 会抢占公钥指纹为该值的用户的注册
+	if isUserIDShaped(cid) {
+		return fmt.Errorf("cid %s has the form of a userID", cid)
+	}
+	exist, err := ctx.GetStub().GetState(cid)
+	if err != nil {
+		return fmt.Errorf("get state for cid %s failed: %v", cid, err)
+	}
+	if exist != nil {
+		return fmt.Errorf("resource with cid %s already exists", cid)
+	}
+	return nil
+}
+
+func putResource(ctx contractapi.TransactionContextInterface, res *Resource) error {
+	b, err := json.Marshal(res)
+	if err != nil {
+		return fmt.Errorf("marshal resource failed: %v", err)
+	}
+	if err := ctx.GetStub().PutState(res.CID, b); err != nil {
+		return fmt.Errorf("put state for cid failed: %v", err)
+	}
+	return nil
+}
+
+/* ---------- 资源策略管理员 (委派) ---------- */
+
+// findResourceAdmin 返回 uid 在 res.Admins 中的下标，不存在返回 -1
+func findResourceAdmin(res *Resource, uid string) int {
+	for i, a := range res.Admins {
+		if a.UID == uid {
+			return i
+		}
+	}
+	return -1
+}
+
+// checkPolicyManager 属主或委派管理员可管理 cid 的授权与拒绝规则
+func checkPolicyManager(res *Resource, uid string) error {
+	if res.OwnerUID == uid || findResourceAdmin(res, uid) >= 0 {
+		return nil
+	}
+	return fmt.Errorf("permission denied: user %s is not owner or admin of cid %s", uid, res.CID)
+}
+
+// AddResourceAdmin(proofJSON, callerID, cid, adminUID, canDelegate)
+// 调用者须为属主，或 CanDelegate 为 true 的管理员；重复添加会覆盖 CanDelegate 但保留原 AddedBy
+// 已有的管理员只能由属主或当初添加他的管理员修改，否则委派管理员可借此接管属主任命的管理员
+func (s *SmartContract) AddResourceAdmin(ctx contractapi.TransactionContextInterface, proofJSON, callerID, cid, adminUID string, canDelegate bool) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if res.OwnerUID != callerID {
+		i := findResourceAdmin(res, callerID)
+		if i < 0 || !res.Admins[i].CanDelegate {
+			return fmt.Errorf("permission denied: user %s cannot delegate admins of cid %s", callerID, cid)
+		}
+	}
+	if _, err := s.authenticate(ctx, callerID, "AddResourceAdmin", proofJSON, callerID, cid, adminUID, strconv.FormatBool(canDelegate)); err != nil {
+		return err
+	}
+	if adminUID == res.OwnerUID {
+		return fmt.Errorf("user %s already owns cid %s", adminUID, cid)
+	}
+	u, err := loadUser(ctx, adminUID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("user %s not found", adminUID)
+	}
+
+	if i := findResourceAdmin(res, adminUID); i >= 0 {
+		if callerID != res.OwnerUID && callerID != res.Admins[i].AddedBy {
+			return fmt.Errorf("permission denied: user %s cannot change admin %s of cid %s", callerID, adminUID, cid)
+		}
+		res.Admins[i].CanDelegate = canDelegate
+	} else {
+		res.Admins = append(res.Admins, ResourceAdmin{UID: adminUID, CanDelegate: canDelegate, AddedBy: callerID})
+	}
+	if err := putResource(ctx, res); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventResourceAdminAdded, UID: callerID, CID: cid, Target: adminUID}); err != nil {
+		return err
+	}
+	log.Printf("[AddResourceAdmin] cid=%s admin=%s canDelegate=%t by=%s", cid, adminUID, canDelegate, callerID)
+	return nil
+}
+
+// RemoveResourceAdmin(proofJSON, callerID, cid, adminUID)
+// 属主可移除任意管理员；管理员只能移除自己委派的管理员，或主动退出
+func (s *SmartContract) RemoveResourceAdmin(ctx contractapi.TransactionContextInterface, proofJSON, callerID, cid, adminUID string) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	i := findResourceAdmin(res, adminUID)
+	if i < 0 {
+		return fmt.Errorf("user %s is not admin of cid %s", adminUID, cid)
+	}
+	if callerID != res.OwnerUID && callerID != adminUID && callerID != res.Admins[i].AddedBy {
+		return fmt.Errorf("permission denied: user %s cannot remove admin %s of cid %s", callerID, adminUID, cid)
+	}
+	if _, err := s.authenticate(ctx, callerID, "RemoveResourceAdmin", proofJSON, callerID, cid, adminUID); err != nil {
+		return err
+	}
+
+	res.Admins = append(res.Admins[:i], res.Admins[i+1:]...)
+	if err := putResource(ctx, res); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventResourceAdminRemoved, UID: callerID, CID: cid, Target: adminUID}); err != nil {
+		return err
+	}
+	log.Printf("[RemoveResourceAdmin] cid=%s admin=%s by=%s", cid, adminUID, callerID)
+	return nil
+}
+
+/* ---------- 属主转移 (两阶段) ---------- */
+
+// OfferOwnership(proofJSON, ownerID, cid, newOwnerID) 由当前属主发起转移，覆盖之前未被接受的邀请
+func (s *SmartContract) OfferOwnership(ctx contractapi.TransactionContextInterface, proofJSON, ownerID, cid, newOwnerID string) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if res.OwnerUID != ownerID {
+		return fmt.Errorf("permission denied: user %s is not owner of cid %s", ownerID, cid)
+	}
+	if newOwnerID == ownerID {
+		return fmt.Errorf("user %s already owns cid %s", ownerID, cid)
+	}
+	if _, err := s.QueryUserID(ctx, newOwnerID); err != nil {
+		return err
+	}
+	if _, err := s.authenticate(ctx, ownerID, "OfferOwnership", proofJSON, ownerID, cid, newOwnerID); err != nil {
+		return err
+	}
+
+	res.PendingOwnerUID = newOwnerID
+	if err := putResource(ctx, res); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventOwnershipOffered, UID: ownerID, CID: cid, Target: newOwnerID}); err != nil {
+		return err
+	}
+	log.Printf("[OfferOwnership] cid=%s owner=%s to=%s", cid, ownerID, newOwnerID)
+	return nil
+}
+
+// CancelOwnershipOffer(proofJSON, ownerID, cid) 撤回尚未被接受的转移邀请
+func (s *SmartContract) CancelOwnershipOffer(ctx contractapi.TransactionContextInterface, proofJSON, ownerID, cid string) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if res.OwnerUID != ownerID {
+		return fmt.Errorf("permission denied: user %s is not owner of cid %s", ownerID, cid)
+	}
+	if res.PendingOwnerUID == "" {
+		return fmt.Errorf("cid %s has no pending ownership offer", cid)
+	}
+	if _, err := s.authenticate(ctx, ownerID, "CancelOwnershipOffer", proofJSON, ownerID, cid); err != nil {
+		return err
+	}
+
+	pending := res.PendingOwnerUID
+	res.PendingOwnerUID = ""
+	if err := putResource(ctx, res); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventOwnershipOfferCancelled, UID: ownerID, CID: cid, Target: pending}); err != nil {
+		return err
+	}
+	log.Printf("[CancelOwnershipOffer] cid=%s owner=%s", cid, ownerID)
+	return nil
+}
+
+// AcceptOwnership(proofJSON, newOwnerID, cid) 由被邀请方签名接受，完成转移并追加历史
+func (s *SmartContract) AcceptOwnership(ctx contractapi.TransactionContextInterface, proofJSON, newOwnerID, cid string) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if res.PendingOwnerUID == "" || res.PendingOwnerUID != newOwnerID {
+		return fmt.Errorf("permission denied: no ownership offer for user %s on cid %s", newOwnerID, cid)
+	}
+	if _, err := s.authenticate(ctx, newOwnerID, "AcceptOwnership", proofJSON, newOwnerID, cid); err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+
+	res.Transfers = append(res.Transfers, OwnershipTransfer{FromUID: res.OwnerUID, ToUID: newOwnerID, Time: now})
+	res.OwnerUID = newOwnerID
+	res.PendingOwnerUID = ""
+	// 新属主若原为委派管理员则从列表移除，其余管理员保留
+	if i := findResourceAdmin(res, newOwnerID); i >= 0 {
+		res.Admins = append(res.Admins[:i], res.Admins[i+1:]...)
+	}
+	if err := putResource(ctx, res); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventOwnershipAccepted, UID: newOwnerID, CID: cid, Target: res.Transfers[len(res.Transfers)-1].FromUID}); err != nil {
+		return err
+	}
+	log.Printf("[AcceptOwnership] cid=%s owner=%s", cid, newOwnerID)
+	return nil
+}
+
+/* ---------- 重构后的 AddPerm (解决 MVCC 冲突) ---------- */
+
+// AddPerm(proofJSON, userID, cid, operation, rolesJSON, notBefore, notAfter)
+// userID 为属主或委派管理员；notBefore/notAfter 为可选的 RFC3339 时间，传空串表示该端不设限
+func (s *SmartContract) AddPerm(
+	ctx contractapi.TransactionContextInterface,
+	proofJSON string,
+	userID string,
+	cid string,
+	operation string,
+	rolesJSON string,
+	notBefore string,
+	notAfter string,
+) error {
+	totalStart := time.Now()
+
+	// (1) 验证属主或委派管理员
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if err := checkPolicyManager(res, userID); err != nil {
+		return err
+	}
+
+	// (2) 验签
+	if _, err := s.authenticate(ctx, userID, "AddPerm", proofJSON, userID, cid, operation, rolesJSON, notBefore, notAfter); err != nil {
+		return err
+	}
+
+	// (3) 赋权 - 核心修改部分
+	var targetRoles []string
+	if err := json.Unmarshal([]byte(rolesJSON), &targetRoles); err != nil {
+		return fmt.Errorf("parse rolesJSON failed: %v", err)
+	}
+	grant, err := parseGrantWindow(notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+
+	sysRoles, err := getRoleSet(ctx)
+	if err != nil {
+		return err
+	}
+	if err := putRoleGrants(ctx, sysRoles, cid, operation, targetRoles, grant); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventPermGranted, UID: userID, CID: cid, Operation: operation, Roles: targetRoles, GrantType: grantTypeRole}); err != nil {
+		return err
+	}
+
+	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
+	log.Printf("[AddPerm] cid=%s owner=%s roles=%d elapsed=%.3f ms", cid, userID, len(targetRoles), elapsedMs)
+	return nil
+}
+
+// putRoleGrants 校验角色均已定义后逐个写入 policy 组合键
+func putRoleGrants(ctx contractapi.TransactionContextInterface, sysRoles []string, cid, operation string, roles []string, grant *PolicyGrant) error {
+	// 快速构建 Set 做检查
+	roleMap := make(map[string]bool)
+	for _, r := range sysRoles {
+		roleMap[r] = true
+	}
+
+	for _, role := range roles {
+		if !roleMap[role] {
+			return fmt.Errorf("role %q not in system roleSet", role)
+		}
+
+		// 使用组合键直接写入！
+		// 这一步不需要读取旧数据，直接覆盖写入，效率极高且无冲突
+		if err := putPolicyEntry(ctx, role, cid, operation, grant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* ---------- 批量发布 ---------- */
+
+// BatchSummary 为批量交易写入内容的汇总
+type BatchSummary struct {
+	CIDs    []string `json:"cids"`    // 涉及的 cid，按首次出现顺序
+	Entries int      `json:"entries"` // 写入的资源记录或 policy 组合键数量
+}
+
+// PermGrantSpec 为 AddPermBatch 中的一条授权，字段含义同 AddPerm 的参数
+type PermGrantSpec struct {
+	CID       string   `json:"cid"`
+	Operation string   `json:"operation"`
+	Roles     []string `json:"roles"`
+	NotBefore string   `json:"notBefore,omitempty"`
+	NotAfter  string   `json:"notAfter,omitempty"`
+}
+
+// parseGrantSpecs 解析批量授权数组，空串视为空数组；数量不得超过 batchMaxSize
+func parseGrantSpecs(grantsJSON string) ([]PermGrantSpec, error) {
+	var specs []PermGrantSpec
+	if grantsJSON == "" {
+		return specs, nil
+	}
+	if err := json.Unmarshal([]byte(grantsJSON), &specs); err != nil {
+		return nil, fmt.Errorf("parse grantsJSON failed: %v", err)
+	}
+	if len(specs) > batchMaxSize {
+		return nil, fmt.Errorf("grant count must be at most %d", batchMaxSize)
+	}
+	return specs, nil
+}
+
+// putGrantSpec 写入一条批量授权的全部 policy 组合键，返回写入数量
+func putGrantSpec(ctx contractapi.TransactionContextInterface, sysRoles []string, spec PermGrantSpec) (int, error) {
+	grant, err := parseGrantWindow(spec.NotBefore, spec.NotAfter)
+	if err != nil {
+		return 0, fmt.Errorf("cid %s: %v", spec.CID, err)
+	}
+	if err := putRoleGrants(ctx, sysRoles, spec.CID, spec.Operation, spec.Roles, grant); err != nil {
+		return 0, fmt.Errorf("cid %s: %v", spec.CID, err)
+	}
+	return len(spec.Roles), nil
+}
+
+// AddResourceBatch(proofJSON, userID, cidsJSON, grantsJSON) 以 userID 为属主注册一组 cid，并在同一交易中写入可选的初始授权
+// grantsJSON 为空串或 "[]" 时只注册资源；其中每条授权的 cid 都须属于本批，签名同时覆盖 cidsJSON 与 grantsJSON
+// 全部成功或全部失败：任一 cid 已存在、角色未定义或授权越出本批时整笔交易报错，不会写入任何记录
+func (s *SmartContract) AddResourceBatch(ctx contractapi.TransactionContextInterface, proofJSON, userID, cidsJSON, grantsJSON string) (*BatchSummary, error) {
+	totalStart := time.Now()
+
+	cids, err := parseCIDList(cidsJSON)
+	if err != nil {
+		return nil, err
+	}
+	specs, err := parseGrantSpecs(grantsJSON)
+	if err != nil {
+		return nil, err
+	}
+	inBatch := make(map[string]bool, len(cids))
+	for _, cid := range cids {
+		inBatch[cid] = true
+	}
+	for _, spec := range specs {
+		if !inBatch[spec.CID] {
+			return nil, fmt.Errorf("grant cid %s is not in this batch", spec.CID)
+		}
+	}
+	if _, err := s.authenticate(ctx, userID, "AddResourceBatch", proofJSON, userID, cidsJSON, grantsJSON); err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &BatchSummary{CIDs: cids}
+	for _, cid := range cids {
+		if err := checkResourceAbsent(ctx, cid); err != nil {
+			return nil, err
+		}
+		if err := putResource(ctx, &Resource{OwnerUID: userID, CID: cid, Created: now}); err != nil {
+			return nil, err
+		}
+		summary.Entries++
+	}
+	if len(specs) > 0 {
+		sysRoles, err := getRoleSet(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range specs {
+			n, err := putGrantSpec(ctx, sysRoles, spec)
+			if err != nil {
+				return nil, err
+			}
+			summary.Entries += n
+		}
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventResourceAddedBatch, UID: userID, CIDs: cids}); err != nil {
+		return nil, err
+	}
+
+	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
+	log.Printf("[AddResourceBatch] owner=%s cids=%d grants=%d entries=%d elapsed=%.3f ms", userID, len(cids), len(specs), summary.Entries, elapsedMs)
+	return summary, nil
+}
+
+// AddPermBatch(proofJSON, userID, grantsJSON) 按 PermGrantSpec 数组批量授权，userID 须为每个 cid 的属主或委派管理员
+// 全部成功或全部失败；用于已注册的 cid，新发布的 cid 应在 AddResourceBatch 中一并授权
+func (s *SmartContract) AddPermBatch(ctx contractapi.TransactionContextInterface, proofJSON, userID, grantsJSON string) (*BatchSummary, error) {
+	totalStart := time.Now()
+
+	specs, err := parseGrantSpecs(grantsJSON)
+	if err != nil {
+		return nil, err
+	}
+	if len(specs) == 0 {
+		return nil, fmt.Errorf("grant count must be between 1 and %d", batchMaxSize)
+	}
+	if _, err := s.authenticate(ctx, userID, "AddPermBatch", proofJSON, userID, grantsJSON); err != nil {
+		return nil, err
+	}
 	sysRoles, err := getRoleSet(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	summary := &BatchSummary{CIDs: []string{}}
+	checked := make(map[string]bool)
+	for _, spec := range specs {
+		if !checked[spec.CID] {
+			res, err := getActiveResource(ctx, spec.CID)
+			if err != nil {
+				return nil, err
+			}
+			if err := checkPolicyManager(res, userID); err != nil {
+				return nil, err
+			}
+			checked[spec.CID] = true
+			summary.CIDs = append(summary.CIDs, spec.CID)
+		}
+		n, err := putGrantSpec(ctx, sysRoles, spec)
+		if err != nil {
+			return nil, err
+		}
+		summary.Entries += n
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventPermGrantedBatch, UID: userID, CIDs: summary.CIDs, GrantType: grantTypeRole}); err != nil {
+		return nil, err
+	}
+
+	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
+	log.Printf("[AddPermBatch] owner=%s cids=%d entries=%d elapsed=%.3f ms", userID, len(summary.CIDs), summary.Entries, elapsedMs)
+	return summary, nil
+}
+
+/* ---------- RevokePerm (撤销角色授权) ---------- */
+
+// RevokePerm(proofJSON, userID, cid, operation, rolesJSON)
+// 删除 AddPerm 写入的组合键，并在 cid 的访问日志中留下撤销记录，供 TraceCid 追溯
+func (s *SmartContract) RevokePerm(
+	ctx contractapi.TransactionContextInterface,
+	proofJSON string,
+	userID string,
+	cid string,
+	operation string,
+	rolesJSON string,
+) error {
+	totalStart := time.Now()
+
+	// (1) 验证属主或委派管理员
+	res, err := getActiveResource(ctx, cid)
 	if err != nil {
 		return err
 	}
-	// 快速构建 Set 做检查
-	roleMap := make(map[string]bool)
-	for _, r := range sysRoles {
-		roleMap[r] = true
+	if err := checkPolicyManager(res, userID); err != nil {
+		return err
+	}
+
+	// (2) 验签
+	if _, err := s.authenticate(ctx, userID, "RevokePerm", proofJSON, userID, cid, operation, rolesJSON); err != nil {
+		return err
+	}
+
+	// (3) 删除组合键
+	var targetRoles []string
+	if err := json.Unmarshal([]byte(rolesJSON), &targetRoles); err != nil {
+		return fmt.Errorf("parse rolesJSON failed: %v", err)
 	}
 
-	updatedCount := 0
+	var revoked []string
 	for _, role := range targetRoles {
-		if !roleMap[role] {
-			return fmt.Errorf("role %q not in system roleSet", role)
+		existed, err := deletePolicyEntry(ctx, role, cid, operation)
+		if err != nil {
+			return err
 		}
+		if existed {
+			revoked = append(revoked, role)
+		}
+	}
+	if len(revoked) == 0 {
+		return fmt.Errorf("no %s grant found on cid %s for roles %v", operation, cid, targetRoles)
+	}
 
-		// 使用组合键直接写入！
-		// 这一步不需要读取旧数据，直接覆盖写入，效率极高且无冲突
-		if err := putPolicyEntry(ctx, role, cid, operation); err != nil {
+	// (4) 记录撤销：UID 为执行撤销的属主或管理员，Roles 为失去权限的角色
+	if err := putAccessLog(ctx, cid, AccessLog{
+		UID:       userID,
+		Decision:  "Revoke",
+		Operation: operation,
+		Roles:     revoked,
+		GrantType: grantTypeRole,
+	}); err != nil {
+		return fmt.Errorf("log revocation failed: %v", err)
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventPermRevoked, UID: userID, CID: cid, Operation: operation, Roles: revoked, GrantType: grantTypeRole}); err != nil {
+		return err
+	}
+
+	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
+	log.Printf("[RevokePerm] cid=%s owner=%s roles=%d elapsed=%.3f ms", cid, userID, len(revoked), elapsedMs)
+	return nil
+}
+
+/* ---------- 用户直接授权 ---------- */
+
+// GrantUserPerm(proofJSON, ownerID, cid, operation, targetUID, notBefore, notAfter)
+// 不经过角色，直接把 cid 上的 operation 授予单个已注册用户；有效期语义同 AddPerm
+func (s *SmartContract) GrantUserPerm(
+	ctx contractapi.TransactionContextInterface,
+	proofJSON string,
+	ownerID string,
+	cid string,
+	operation string,
+	targetUID string,
+	notBefore string,
+	notAfter string,
+) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if err := checkPolicyManager(res, ownerID); err != nil {
+		return err
+	}
+	if _, err := s.authenticate(ctx, ownerID, "GrantUserPerm", proofJSON, ownerID, cid, operation, targetUID, notBefore, notAfter); err != nil {
+		return err
+	}
+
+	u, err := loadUser(ctx, targetUID)
+	if err != nil {
+		return err
+	}
+	if u == nil {
+		return fmt.Errorf("target user %s not found", targetUID)
+	}
+	grant, err := parseGrantWindow(notBefore, notAfter)
+	if err != nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(userPolicyObjType, []string{cid, targetUID, operation})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	val, err := json.Marshal(grant)
+	if err != nil {
+		return fmt.Errorf("marshal policy grant failed: %v", err)
+	}
+	if err := ctx.GetStub().PutState(key, val); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventPermGranted, UID: ownerID, CID: cid, Operation: operation, GrantType: grantTypeUser, Target: targetUID}); err != nil {
+		return err
+	}
+
+	log.Printf("[GrantUserPerm] cid=%s op=%s target=%s owner=%s", cid, operation, targetUID, ownerID)
+	return nil
+}
+
+// RevokeUserPerm(proofJSON, ownerID, cid, operation, targetUID) 删除用户直接授权并记录撤销日志
+func (s *SmartContract) RevokeUserPerm(ctx contractapi.TransactionContextInterface, proofJSON, ownerID, cid, operation, targetUID string) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if err := checkPolicyManager(res, ownerID); err != nil {
+		return err
+	}
+	if _, err := s.authenticate(ctx, ownerID, "RevokeUserPerm", proofJSON, ownerID, cid, operation, targetUID); err != nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(userPolicyObjType, []string{cid, targetUID, operation})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	val, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return fmt.Errorf("no %s grant found on cid %s for user %s", operation, cid, targetUID)
+	}
+	if err := ctx.GetStub().DelState(key); err != nil {
+		return fmt.Errorf("delete user grant failed: %v", err)
+	}
+
+	if err := putAccessLog(ctx, cid, AccessLog{
+		UID:       ownerID,
+		Decision:  "Revoke",
+		Operation: operation,
+		GrantType: grantTypeUser,
+		Target:    targetUID,
+	}); err != nil {
+		return fmt.Errorf("log revocation failed: %v", err)
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventPermRevoked, UID: ownerID, CID: cid, Operation: operation, GrantType: grantTypeUser, Target: targetUID}); err != nil {
+		return err
+	}
+
+	log.Printf("[RevokeUserPerm] cid=%s op=%s target=%s owner=%s", cid, operation, targetUID, ownerID)
+	return nil
+}
+
+// getUserGrant 读取用户直接授权，不存在时返回 nil
+func getUserGrant(ctx contractapi.TransactionContextInterface, cid, userID, operation string) (*PolicyGrant, error) {
+	key, err := ctx.GetStub().CreateCompositeKey(userPolicyObjType, []string{cid, userID, operation})
+	if err != nil {
+		return nil, fmt.Errorf("create composite key failed: %v", err)
+	}
+	val, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return nil, err
+	}
+	return decodePolicyGrant(val)
+}
+
+/* ---------- RemoveResource (墓碑化) ---------- */
+
+// RemoveResource(proofJSON, ownerID, cid)
+// 资源记录保留为墓碑，清除该 cid 的全部 policy、userpolicy 与 deny 组合键，访问日志原样保留
+func (s *SmartContract) RemoveResource(ctx contractapi.TransactionContextInterface, proofJSON, ownerID, cid string) error {
+	totalStart := time.Now()
+
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if res.OwnerUID != ownerID {
+		return fmt.Errorf("permission denied: user %s is not owner of cid %s", ownerID, cid)
+	}
+	if _, err := s.authenticate(ctx, ownerID, "RemoveResource", proofJSON, ownerID, cid); err != nil {
+		return err
+	}
+
+	purged, err := purgePolicyEntries(ctx, cid)
+	if err != nil {
+		return err
+	}
+	for _, objType := range []string{denyObjType, userPolicyObjType} {
+		n, err := purgeByPartialKey(ctx, objType, []string{cid})
+		if err != nil {
+			return err
+		}
+		purged += n
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	res.Tombstone = &Tombstone{RemovedBy: ownerID, RemovedAt: now}
+	res.PendingOwnerUID = ""
+	if err := putResource(ctx, res); err != nil {
+		return err
+	}
+	if err := putAccessLog(ctx, cid, AccessLog{
+		UID:      ownerID,
+		Decision: "Remove",
+	}); err != nil {
+		return fmt.Errorf("log removal failed: %v", err)
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventResourceRemoved, UID: ownerID, CID: cid}); err != nil {
+		return err
+	}
+
+	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
+	log.Printf("[RemoveResource] cid=%s owner=%s purged=%d elapsed=%.3f ms", cid, ownerID, purged, elapsedMs)
+	return nil
+}
+
+// purgePolicyEntries 对每个系统角色按 [role, cid] 前缀迭代 policy 组合键并删除，返回删除数量
+func purgePolicyEntries(ctx contractapi.TransactionContextInterface, cid string) (int, error) {
+	roles, err := getRoleSet(ctx)
+	if err != nil {
+		return 0, err
+	}
+	purged := 0
+	for _, role := range roles {
+		n, err := purgeByPartialKey(ctx, policyObjType, []string{role, cid})
+		if err != nil {
+			return 0, err
+		}
+		purged += n
+	}
+	return purged, nil
+}
+
+// purgeByPartialKey 删除 objType 下以 attrs 为前缀的全部组合键，返回删除数量
+func purgeByPartialKey(ctx contractapi.TransactionContextInterface, objType string, attrs []string) (int, error) {
+	it, err := ctx.GetStub().GetStateByPartialCompositeKey(objType, attrs)
+	if err != nil {
+		return 0, fmt.Errorf("get %s entries failed: %v", objType, err)
+	}
+	defer it.Close()
+
+	purged := 0
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return 0, err
+		}
+		if err := ctx.GetStub().DelState(kv.Key); err != nil {
+			return 0, fmt.Errorf("delete %s entry failed: %v", objType, err)
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+/* ---------- 显式拒绝规则 (deny-overrides) ---------- */
+
+const (
+	denySubjectRole = "role:"
+	denySubjectUser = "user:"
+)
+
+// validateDenySubject 校验 subject 为 "role:<已定义角色>" 或 "user:<已注册用户>"
+func validateDenySubject(ctx contractapi.TransactionContextInterface, subject string) error {
+	switch {
+	case strings.HasPrefix(subject, denySubjectRole):
+		roles, err := getRoleSet(ctx)
+		if err != nil {
+			return err
+		}
+		if !containsString(roles, strings.TrimPrefix(subject, denySubjectRole)) {
+			return fmt.Errorf("invalid role in deny subject %q", subject)
+		}
+	case strings.HasPrefix(subject, denySubjectUser):
+		u, err := loadUser(ctx, strings.TrimPrefix(subject, denySubjectUser))
+		if err != nil {
 			return err
 		}
-		updatedCount++
+		if u == nil {
+			return fmt.Errorf("user in deny subject %q not found", subject)
+		}
+	default:
+		return fmt.Errorf("deny subject must start with %q or %q", denySubjectRole, denySubjectUser)
+	}
+	return nil
+}
+
+// hasDenyRuleForSubject 判断是否有任何 cid 上存在以 subject 为主体的拒绝规则
+// deny 组合键以 cid 开头，只能遍历全部规则；仅供 RemoveRole 这类低频管理操作使用
+func hasDenyRuleForSubject(ctx contractapi.TransactionContextInterface, subject string) (bool, error) {
+	it, err := ctx.GetStub().GetStateByPartialCompositeKey(denyObjType, []string{})
+	if err != nil {
+		return false, fmt.Errorf("get deny rules failed: %v", err)
+	}
+	defer it.Close()
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return false, err
+		}
+		_, attrs, err := ctx.GetStub().SplitCompositeKey(kv.Key)
+		if err != nil {
+			return false, fmt.Errorf("split composite key failed: %v", err)
+		}
+		if len(attrs) == 3 && attrs[1] == subject {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// AddDenyRule(proofJSON, ownerID, cid, operation, subject) 由属主或委派管理员添加拒绝规则
+// 拒绝优先于任何授权：命中规则的用户即使持有被授权的角色也会被拒绝
+func (s *SmartContract) AddDenyRule(ctx contractapi.TransactionContextInterface, proofJSON, ownerID, cid, operation, subject string) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if err := checkPolicyManager(res, ownerID); err != nil {
+		return err
+	}
+	if _, err := s.authenticate(ctx, ownerID, "AddDenyRule", proofJSON, ownerID, cid, operation, subject); err != nil {
+		return err
+	}
+	if err := validateDenySubject(ctx, subject); err != nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(denyObjType, []string{cid, subject, operation})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	if err := ctx.GetStub().PutState(key, []byte{0x01}); err != nil {
+		return err
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventDenyRuleAdded, UID: ownerID, CID: cid, Operation: operation, Rule: subject}); err != nil {
+		return err
+	}
+
+	log.Printf("[AddDenyRule] cid=%s op=%s subject=%s owner=%s", cid, operation, subject, ownerID)
+	return nil
+}
+
+// RemoveDenyRule(proofJSON, ownerID, cid, operation, subject) 删除拒绝规则，规则不存在时报错
+func (s *SmartContract) RemoveDenyRule(ctx contractapi.TransactionContextInterface, proofJSON, ownerID, cid, operation, subject string) error {
+	res, err := getActiveResource(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if err := checkPolicyManager(res, ownerID); err != nil {
+		return err
+	}
+	if _, err := s.authenticate(ctx, ownerID, "RemoveDenyRule", proofJSON, ownerID, cid, operation, subject); err != nil {
+		return err
+	}
+
+	key, err := ctx.GetStub().CreateCompositeKey(denyObjType, []string{cid, subject, operation})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	val, err := ctx.GetStub().GetState(key)
+	if err != nil {
+		return err
+	}
+	if val == nil {
+		return fmt.Errorf("no deny rule for %s on %s of cid %s", subject, operation, cid)
+	}
+	if err := ctx.GetStub().DelState(key); err != nil {
+		return fmt.Errorf("delete deny rule failed: %v", err)
+	}
+	if err := emitEvent(ctx, ChaincodeEvent{Type: eventDenyRuleRemoved, UID: ownerID, CID: cid, Operation: operation, Rule: subject}); err != nil {
+		return err
 	}
 
-	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
-	log.Printf("[AddPerm] cid=%s owner=%s roles=%d elapsed=%.3f ms", cid, userID, updatedCount, elapsedMs)
+	log.Printf("[RemoveDenyRule] cid=%s op=%s subject=%s owner=%s", cid, operation, subject, ownerID)
 	return nil
 }
 
+// matchDenyRule 依次检查用户本身与其直接持有的角色，返回首个命中的规则主体；无命中返回 ""
+// 角色规则不沿继承关系传播：拒绝 Public 不会连带拒绝持有 Creator 的用户
+func matchDenyRule(ctx contractapi.TransactionContextInterface, userID string, held []string, cid, operation string) (string, error) {
+	subjects := []string{denySubjectUser + userID}
+	for _, role := range held {
+		subjects = append(subjects, denySubjectRole+role)
+	}
+	for _, subject := range subjects {
+		key, err := ctx.GetStub().CreateCompositeKey(denyObjType, []string{cid, subject, operation})
+		if err != nil {
+			return "", fmt.Errorf("create composite key failed: %v", err)
+		}
+		val, err := ctx.GetStub().GetState(key)
+		if err != nil {
+			return "", err
+		}
+		if val != nil {
+			return subject, nil
+		}
+	}
+	return "", nil
+}
+
 /* ---------- 重构后的 CheckPerm (适配组合键) ---------- */
 
-func (s *SmartContract) CheckPerm(ctx contractapi.TransactionContextInterface, signatureB64, operation, userID, cid string) (string, error) {
+// CheckPerm(proofJSON, operation, userID, cid)
+// 未注册用户与签名无效的请求返回 "Deny" 而不是报错；这类未认证的拒绝只记入 unauthlog，
+// 不写入 cid 日志与 uidlog，避免任何人以任意 userID 伪造该用户的访问记录
+func (s *SmartContract) CheckPerm(ctx contractapi.TransactionContextInterface, proofJSON, operation, userID, cid string) (string, error) {
 	totalStart := time.Now()
 
-	// 1. 获取用户
-	u, err := s.QueryUserID(ctx, userID)
+	// 1-3. 获取用户、验签 (登记 nonce)、检查权限
+	entry, err := decideAccess(ctx, "CheckPerm", proofJSON, operation, userID, cid, true)
 	if err != nil {
 		return "", err
 	}
-	role := u.Role
 
-	// 2. 验签
-	pub, err := parsePublicKeyPEM(u.PK)
+	// 4. 写日志 (保持你之前的无冲突写法)，并通知监听方
+	if isUnauthenticated(entry.Reason) {
+		err = putUnauthLog(ctx, cid, *entry)
+	} else {
+		err = putAccessLog(ctx, cid, *entry)
+	}
 	if err != nil {
-		return "", fmt.Errorf("parse pubkey failed: %v", err)
+		return "", fmt.Errorf("logGen failed: %v", err)
 	}
-	if err := verifySignature(userID, cid, signatureB64, pub); err != nil {
-		_ = logGen(ctx, cid, userID, "Deny")
-		return "", fmt.Errorf("signature verify failed: %v", err)
+	if err := emitEvent(ctx, ChaincodeEvent{
+		Type:       eventAccessDecided,
+		UID:        entry.UID,
+		ClaimedUID: entry.ClaimedUID,
+		CID:        cid,
+		Operation:  operation,
+		Role:       entry.Role,
+		GrantType:  entry.GrantType,
+		Rule:       entry.Rule,
+		Decision:   entry.Decision,
+		Reason:     entry.Reason,
+	}); err != nil {
+		return "", err
 	}
 
-	// 3. 检查权限 - 核心修改部分
-	// 不再读取大数组，而是直接检查组合键是否存在
-	allowed, err := hasPolicyEntry(ctx, role, cid, operation)
+	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
+	log.Printf("[CheckPerm] uid=%s cid=%s decision=%s reason=%s elapsed=%.3f ms", userID, cid, entry.Decision, entry.Reason, elapsedMs)
+	return entry.Decision, nil
+}
+
+// EvaluatePerm(proofJSON, operation, userID, cid) 只读的预检：判定逻辑与 CheckPerm 相同，但不写日志、不登记 nonce、不发事件
+// 供界面与客户端通过 EvaluateTransaction 询问“是否会被允许”；真正访问仍须提交 CheckPerm 以留下审计记录
+func (s *SmartContract) EvaluatePerm(ctx contractapi.TransactionContextInterface, proofJSON, operation, userID, cid string) (*AccessLog, error) {
+	start := time.Now()
+	entry, err := decideAccess(ctx, "EvaluatePerm", proofJSON, operation, userID, cid, false)
 	if err != nil {
-		_ = logGen(ctx, cid, userID, "Deny")
-		return "", err
+		return nil, err
+	}
+	// 未写入账本，不填 TxID；Time 为评估所依据的交易时间
+	if entry.Time, err = txTime(ctx); err != nil {
+		return nil, err
 	}
+	elapsedMs := float64(time.Since(start).Microseconds()) / 1000.0
+	log.Printf("[EvaluatePerm] uid=%s cid=%s decision=%s reason=%s elapsed=%.3f ms", userID, cid, entry.Decision, entry.Reason, elapsedMs)
+	return entry, nil
+}
 
-	decision := "Deny"
-	if allowed {
-		decision = "Permit"
+// decideAccess 为 CheckPerm 与 EvaluatePerm 共用的判定流程，签名须覆盖 fn(operation, userID, cid)
+// consumeNonce 为 false 时只校验签名与有效期；未注册用户与签名无效均返回 Deny 而非错误
+func decideAccess(ctx contractapi.TransactionContextInterface, fn, proofJSON, operation, userID, cid string, consumeNonce bool) (*AccessLog, error) {
+	u, reason, err := identifyRequester(ctx, fn, proofJSON, userID, consumeNonce, operation, userID, cid)
+	if err != nil {
+		return nil, err
 	}
+	return accessEntry(ctx, u, reason, operation, userID, cid)
+}
 
-	// 4. 写日志 (保持你之前的无冲突写法)
-	if err := logGen(ctx, cid, userID, decision); err != nil {
-		return "", fmt.Errorf("logGen failed: %v", err)
+// identifyRequester 读取用户并校验其对 fn(args...) 的签名凭据
+// 用户未注册或签名无效时返回对应的拒绝原因而不是错误；验签失败时 nonce 不会登记
+// 停用或吊销状态在验签之后检查，因此 user_suspended / user_revoked 的拒绝已经过认证
+func identifyRequester(ctx contractapi.TransactionContextInterface, fn, proofJSON, userID string, consumeNonce bool, args ...string) (*User, string, error) {
+	u, err := loadUser(ctx, userID)
+	if err != nil {
+		return nil, "", err
+	}
+	if u == nil {
+		return nil, denyReasonUnknownUser, nil
+	}
+	pub, err := parsePublicKeyPEM(u.PK)
+	if err != nil {
+		return nil, "", fmt.Errorf("parse pubkey failed: %v", err)
+	}
+	if consumeNonce {
+		err = verifyProof(ctx, userID, pub, fn, proofJSON, args...)
+	} else {
+		_, err = checkProof(ctx, pub, fn, proofJSON, args...)
+	}
+	if err != nil {
+		log.Printf("[%s] uid=%s signature rejected: %v", fn, userID, err)
+		return u, denyReasonBadSignature, nil
+	}
+	switch u.Status {
+	case userStatusSuspended:
+		return u, denyReasonUserSuspended, nil
+	case userStatusRevoked:
+		return u, denyReasonUserRevoked, nil
+	}
+	return u, "", nil
+}
+
+// isUnauthenticated 判断拒绝原因是否表示请求者身份未经验证
+func isUnauthenticated(reason string) bool {
+	return reason == denyReasonUnknownUser || reason == denyReasonBadSignature
+}
+
+// accessEntry 构造 cid 的判定结果；reason 非空表示请求者未通过认证或已被停用，直接拒绝
+// 未通过认证时 userID 只记入 ClaimedUID，不作为记录的 UID
+func accessEntry(ctx contractapi.TransactionContextInterface, u *User, reason, operation, userID, cid string) (*AccessLog, error) {
+	if isUnauthenticated(reason) {
+		return &AccessLog{ClaimedUID: userID, Decision: "Deny", Operation: operation, Reason: reason}, nil
+	}
+	entry := &AccessLog{UID: userID, Decision: "Deny", Operation: operation, Reason: reason, Roles: u.Roles}
+	if reason != "" {
+		return entry, nil
+	}
+	if err := evaluateAccess(ctx, u, userID, cid, operation, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// batchMaxSize 限制批量交易一次处理的 cid 数量，避免读写集过大
+const batchMaxSize = 500
+
+// parseCIDList 解析批量交易的 cid 数组，拒绝空数组、超限与重复项
+func parseCIDList(cidsJSON string) ([]string, error) {
+	var cids []string
+	if err := json.Unmarshal([]byte(cidsJSON), &cids); err != nil {
+		return nil, fmt.Errorf("parse cidsJSON failed: %v", err)
+	}
+	if len(cids) == 0 || len(cids) > batchMaxSize {
+		return nil, fmt.Errorf("cid count must be between 1 and %d", batchMaxSize)
+	}
+	seen := make(map[string]bool, len(cids))
+	for _, cid := range cids {
+		if cid == "" {
+			return nil, fmt.Errorf("cid must not be empty")
+		}
+		if seen[cid] {
+			return nil, fmt.Errorf("duplicate cid %s", cid)
+		}
+		seen[cid] = true
+	}
+	return cids, nil
+}
+
+// CheckPermBatch(proofJSON, operation, userID, cidsJSON) 用一个签名对多个 cid 做 CheckPerm
+// 每个 cid 各写一条访问日志，返回 cid -> "Permit"/"Deny"；事件合并为一条 AccessDecidedBatch
+// 未通过认证时的记录规则同 CheckPerm
+func (s *SmartContract) CheckPermBatch(ctx contractapi.TransactionContextInterface, proofJSON, operation, userID, cidsJSON string) (map[string]string, error) {
+	totalStart := time.Now()
+
+	cids, err := parseCIDList(cidsJSON)
+	if err != nil {
+		return nil, err
+	}
+	u, reason, err := identifyRequester(ctx, "CheckPermBatch", proofJSON, userID, true, operation, userID, cidsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	unauth := isUnauthenticated(reason)
+	decisions := make(map[string]string, len(cids))
+	permitted := 0
+	for _, cid := range cids {
+		entry, err := accessEntry(ctx, u, reason, operation, userID, cid)
+		if err != nil {
+			return nil, err
+		}
+		if unauth {
+			err = putUnauthLog(ctx, cid, *entry)
+		} else {
+			err = putAccessLog(ctx, cid, *entry)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("logGen failed: %v", err)
+		}
+		decisions[cid] = entry.Decision
+		if entry.Decision == "Permit" {
+			permitted++
+		}
+	}
+	ev := ChaincodeEvent{Type: eventAccessDecidedBatch, UID: userID, Operation: operation, Decisions: decisions, Reason: reason}
+	if unauth {
+		ev.UID, ev.ClaimedUID = "", userID
+	}
+	if err := emitEvent(ctx, ev); err != nil {
+		return nil, err
 	}
 
 	elapsedMs := float64(time.Since(totalStart).Microseconds()) / 1000.0
-	log.Printf("[CheckPerm] uid=%s cid=%s decision=%s elapsed=%.3f ms", userID, cid, decision, elapsedMs)
-	return decision, nil
+	log.Printf("[CheckPermBatch] uid=%s cids=%d permit=%d elapsed=%.3f ms", userID, len(cids), permitted, elapsedMs)
+	return decisions, nil
 }
 
-/* ---------- 辅助查询功能 ---------- */
+// evaluateAccess 依次检查 墓碑 → 拒绝规则 (deny-overrides) → 用户直接授权 → 持有角色授权，结论写入 entry
+// 不再读取大数组，而是直接检查组合键是否存在；有效期按交易时间戳判定，保证各背书节点结论一致
+func evaluateAccess(ctx contractapi.TransactionContextInterface, u *User, userID, cid, operation string, entry *AccessLog) error {
+	removed, err := isResourceRemoved(ctx, cid)
+	if err != nil {
+		return err
+	}
+	if removed {
+		entry.Reason = denyReasonResourceRemoved
+		return nil
+	}
 
-func (s *SmartContract) QueryCid(ctx contractapi.TransactionContextInterface, cid string) (string, error) {
-	start := time.Now()
+	rule, err := matchDenyRule(ctx, userID, u.Roles, cid, operation)
+	if err != nil {
+		return err
+	}
+	if rule != "" {
+		entry.Rule = rule
+		entry.Reason = denyReasonDenyRule
+		return nil
+	}
+
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	grantType, reason, err := matchUserGrant(ctx, userID, cid, operation, now)
+	if err != nil {
+		return err
+	}
+	if grantType != "" {
+		entry.Decision = "Permit"
+		entry.GrantType = grantType
+		return nil
+	}
+
+	// 任一持有角色（含其继承的下级角色）命中即允许
+	winner, roleReason, err := matchHeldRoles(ctx, u.Roles, cid, operation, now)
+	if err != nil {
+		return err
+	}
+	if winner != "" {
+		entry.Decision = "Permit"
+		entry.Role = winner
+		entry.GrantType = grantTypeRole
+		return nil
+	}
+
+	// 两类授权都未生效时保留先遇到的有效期原因，完全没有授权则为 no_policy
+	switch {
+	case reason != "":
+		entry.Reason = reason
+	case roleReason != "":
+		entry.Reason = roleReason
+	default:
+		entry.Reason = denyReasonNoPolicy
+	}
+	return nil
+}
+
+// isResourceRemoved 判断 cid 是否已被墓碑化；未注册的 cid 返回 false，交由授权检查拒绝
+func isResourceRemoved(ctx contractapi.TransactionContextInterface, cid string) (bool, error) {
 	b, err := ctx.GetStub().GetState(cid)
 	if err != nil {
-		return "", fmt.Errorf("get cid failed: %v", err)
+		return false, fmt.Errorf("get cid failed: %v", err)
 	}
 	if b == nil {
-		return "", fmt.Errorf("cid %s not found", cid)
+		return false, nil
 	}
 	var res Resource
 	if err := json.Unmarshal(b, &res); err != nil {
-		return "", fmt.Errorf("unmarshal resource failed: %v", err)
+		return false, fmt.Errorf("unmarshal resource failed: %v", err)
+	}
+	return res.Tombstone != nil, nil
+}
+
+// matchUserGrant 检查用户直接授权，生效时返回 grantTypeUser；存在但不在有效期内时返回原因
+func matchUserGrant(ctx contractapi.TransactionContextInterface, userID, cid, operation string, now time.Time) (grantType, reason string, err error) {
+	grant, err := getUserGrant(ctx, cid, userID, operation)
+	if err != nil || grant == nil {
+		return "", "", err
+	}
+	if inactive := grant.inactiveReason(now); inactive != "" {
+		return "", inactive, nil
+	}
+	return grantTypeUser, "", nil
+}
+
+// matchHeldRoles 按持有顺序检查每个角色及其下级角色，返回首个在 now 时刻生效的授权所对应的持有角色
+// 无命中时 winner 为 ""；若只找到不在有效期内的授权，reason 给出过期或尚未生效
+func matchHeldRoles(ctx contractapi.TransactionContextInterface, held []string, cid, operation string, now time.Time) (winner, reason string, err error) {
+	for _, role := range held {
+		roles, err := effectiveRoles(ctx, role)
+		if err != nil {
+			return "", "", err
+		}
+		for _, r := range roles {
+			grant, err := getPolicyEntry(ctx, r, cid, operation)
+			if err != nil {
+				return "", "", err
+			}
+			if grant == nil {
+				continue
+			}
+			inactive := grant.inactiveReason(now)
+			if inactive == "" {
+				return role, "", nil
+			}
+			reason = inactive
+		}
+	}
+	return "", reason, nil
+}
+
+/* ---------- 链码事件 ---------- */
+
+// 事件名即 SetEvent 的 name，监听方按名称过滤；Fabric 每笔交易只保留最后一次 SetEvent
+const (
+	eventUserRegistered    = "UserRegistered"
+	eventKeyRotated        = "KeyRotated"
+	eventPeerBound         = "PeerBound"
+	eventUserStatusChanged = "UserStatusChanged" // Reason 为新状态，"" 表示恢复正常
+	eventRoleAssigned      = "RoleAssigned"
+	eventRoleUnassigned    = "RoleUnassigned"
+	eventResourceAdded     = "ResourceAdded"
+	eventResourceRemoved   = "ResourceRemoved"
+	eventPermGranted       = "PermGranted"
+	eventPermRevoked       = "PermRevoked"
+	eventDenyRuleAdded     = "DenyRuleAdded"
+	eventDenyRuleRemoved   = "DenyRuleRemoved"
+	eventAccessDecided     = "AccessDecided"
+	// CheckPermBatch 每笔交易只能发一条事件，逐 cid 结论放在 Decisions 中
+	eventAccessDecidedBatch = "AccessDecidedBatch"
+	// 批量发布事件，涉及的 cid 放在 CIDs 中
+	eventResourceAddedBatch = "ResourceAddedBatch"
+	eventPermGrantedBatch   = "PermGrantedBatch"
+	// 配置变更，Operation 为触发的交易名
+	eventConfigChanged = "ConfigChanged"
+	eventRoleAdded     = "RoleAdded"
+	eventRoleRemoved   = "RoleRemoved"
+	// 旧版用户迁移，涉及的用户放在 UIDs 中
+	eventRoleIndexBackfilled = "RoleIndexBackfilled"
+	eventNoncesPurged        = "NoncesPurged"
+	// 角色继承边变更，Role 为上级角色，Target 为下级角色
+	eventRoleInheritanceAdded   = "RoleInheritanceAdded"
+	eventRoleInheritanceRemoved = "RoleInheritanceRemoved"
+	eventResourceAdminAdded     = "ResourceAdminAdded"
+	eventResourceAdminRemoved   = "ResourceAdminRemoved"
+	// 属主转移，Target 为接收方 (Accepted 中为原属主)
+	eventOwnershipOffered        = "OwnershipOffered"
+	eventOwnershipOfferCancelled = "OwnershipOfferCancelled"
+	eventOwnershipAccepted       = "OwnershipAccepted"
+)
+
+// ChaincodeEvent 为所有事件共用的负载，未涉及的字段省略
+type ChaincodeEvent struct {
+	Type      string    `json:"type"`
+	TxID      string    `json:"txID"`
+	Time      time.Time `json:"time"`
+	UID       string    `json:"uid,omitempty"` // 发起者；AccessDecided 中为请求访问的用户
+	CID       string    `json:"cid,omitempty"`
+	Operation string    `json:"operation,omitempty"`
+	Role      string    `json:"role,omitempty"`
+	Roles     []string  `json:"roles,omitempty"`
+	GrantType string    `json:"grantType,omitempty"`
+	Target    string    `json:"target,omitempty"` // 用户授权的接收方或角色变更的用户
+	Rule      string    `json:"rule,omitempty"`
+	Decision  string    `json:"decision,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	// 仅未通过认证的 AccessDecided/AccessDecidedBatch：请求中声称的 userID，此时 UID 为空
+	ClaimedUID string            `json:"claimedUID,omitempty"`
+	Decisions  map[string]string `json:"decisions,omitempty"` // 仅 AccessDecidedBatch: cid -> 结论
+	CIDs       []string          `json:"cids,omitempty"`      // 仅批量发布事件
+	UIDs       []string          `json:"uids,omitempty"`      // 仅 RoleIndexBackfilled
+}
+
+// emitEvent 补全交易号与交易时间后发出事件
+func emitEvent(ctx contractapi.TransactionContextInterface, ev ChaincodeEvent) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	ev.TxID = ctx.GetStub().GetTxID()
+	ev.Time = now
+	b, err := json.Marshal(ev)
+	if err != nil {
+		return fmt.Errorf("marshal event failed: %v", err)
+	}
+	if err := ctx.GetStub().SetEvent(ev.Type, b); err != nil {
+		return fmt.Errorf("set event %s failed: %v", ev.Type, err)
+	}
+	return nil
+}
+
+/* ---------- 辅助查询功能 ---------- */
+
+// QueryCid 返回资源记录，包括当前属主、待接受的转移与历次属主变更
+func (s *SmartContract) QueryCid(ctx contractapi.TransactionContextInterface, cid string) (*Resource, error) {
+	start := time.Now()
+	res, err := getResource(ctx, cid)
+	if err != nil {
+		return nil, err
 	}
 	elapsedMs := float64(time.Since(start).Microseconds()) / 1000.0
 	log.Printf("[QueryCid] cid=%s elapsed=%.3f ms", cid, elapsedMs)
-	return res.OwnerUID, nil
+	return res, nil
 }
 
 func (s *SmartContract) TraceCid(ctx contractapi.TransactionContextInterface, cid string) ([]AccessLog, error) {
@@ -415,15 +3094,264 @@ func (s *SmartContract) TraceCid(ctx contractapi.TransactionContextInterface, ci
 	return logs, nil
 }
 
-// 保持你之前的 LogGen 逻辑，这对并发非常友好
-func logGen(ctx contractapi.TransactionContextInterface, cid, uid, decision string) error {
+// AccessLogPage 为 TraceCidPaged 的一页结果
+type AccessLogPage struct {
+	Logs     []AccessLog `json:"logs"`
+	Bookmark string      `json:"bookmark"` // 传入下一次调用；为空表示已到末尾
+	Fetched  int32       `json:"fetched"`  // 本页从账本读取的记录数 (过滤前)
+	Skipped  int32       `json:"skipped"`  // 本页中无法解析而跳过的记录数
+}
+
+// traceMaxPageSize 限制单页读取量，避免热点文件的查询超出 peer 的响应上限
+const traceMaxPageSize = 1000
+
+// parseTraceFilter 校验分页大小并解析 RFC3339 时间窗口，空串对应零值表示不限
+func parseTraceFilter(pageSize int32, fromTime, toTime string) (from, to time.Time, err error) {
+	if pageSize <= 0 || pageSize > traceMaxPageSize {
+		return from, to, fmt.Errorf("pageSize must be between 1 and %d", traceMaxPageSize)
+	}
+	if fromTime != "" {
+		if from, err = time.Parse(time.RFC3339, fromTime); err != nil {
+			return from, to, fmt.Errorf("parse fromTime failed: %v", err)
+		}
+	}
+	if toTime != "" {
+		if to, err = time.Parse(time.RFC3339, toTime); err != nil {
+			return from, to, fmt.Errorf("parse toTime failed: %v", err)
+		}
+	}
+	return from, to, nil
+}
+
+// inTraceWindow 判断 t 是否落在 [from, to) 内，零值端不限
+func inTraceWindow(t, from, to time.Time) bool {
+	if !from.IsZero() && t.Before(from) {
+		return false
+	}
+	return to.IsZero() || t.Before(to)
+}
+
+// TraceCidPaged(cid, pageSize, bookmark, fromTime, toTime, uid, decision)
+// 按页读取 cid 的访问日志，fromTime/toTime (RFC3339, 含 from 不含 to)、uid、decision 为空时不过滤
+// 过滤在读取之后进行，因此一页返回的条数可能少于 pageSize；以 Bookmark 是否为空判断是否结束
+func (s *SmartContract) TraceCidPaged(
+	ctx contractapi.TransactionContextInterface,
+	cid string,
+	pageSize int32,
+	bookmark string,
+	fromTime string,
+	toTime string,
+	uid string,
+	decision string,
+) (*AccessLogPage, error) {
+	start := time.Now()
+	from, to, err := parseTraceFilter(pageSize, fromTime, toTime)
+	if err != nil {
+		return nil, err
+	}
+
+	startKey := cid + "_log_"
+	endKey := cid + "_log_" + "\uffff"
+	it, meta, err := ctx.GetStub().GetStateByRangeWithPagination(startKey, endKey, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("get logs by range failed: %v", err)
+	}
+	defer it.Close()
+
+	page := &AccessLogPage{Logs: []AccessLog{}, Bookmark: meta.GetBookmark(), Fetched: meta.GetFetchedRecordsCount()}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry AccessLog
+		if err := json.Unmarshal(kv.Value, &entry); err != nil {
+			page.Skipped++
+			continue
+		}
+		if uid != "" && entry.UID != uid {
+			continue
+		}
+		if decision != "" && entry.Decision != decision {
+			continue
+		}
+		if !inTraceWindow(entry.Time, from, to) {
+			continue
+		}
+		page.Logs = append(page.Logs, entry)
+	}
+
+	elapsedMs := float64(time.Since(start).Microseconds()) / 1000.0
+	log.Printf("[TraceCidPaged] cid=%s fetched=%d logs=%d skipped=%d elapsed=%.3f ms", cid, page.Fetched, len(page.Logs), page.Skipped, elapsedMs)
+	return page, nil
+}
+
+// TraceUser(proofJSON, requesterID, uid, fromTime, toTime, pageSize, bookmark)
+// 按 uidlog 索引分页读取 uid 的访问记录；requesterID 须为 uid 本人或持有 Auditor 角色
+// 查询只校验签名与有效期，不消耗 nonce；过滤语义同 TraceCidPaged
+func (s *SmartContract) TraceUser(
+	ctx contractapi.TransactionContextInterface,
+	proofJSON string,
+	requesterID string,
+	uid string,
+	fromTime string,
+	toTime string,
+	pageSize int32,
+	bookmark string,
+) (*AccessLogPage, error) {
+	start := time.Now()
+
+	requester, err := s.QueryUserID(ctx, requesterID)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkUserActive(requesterID, requester); err != nil {
+		return nil, err
+	}
+	pub, err := parsePublicKeyPEM(requester.PK)
+	if err != nil {
+		return nil, fmt.Errorf("parse pubkey failed: %v", err)
+	}
+	if _, err := checkProof(ctx, pub, "TraceUser", proofJSON, requesterID, uid, fromTime, toTime, strconv.FormatInt(int64(pageSize), 10), bookmark); err != nil {
+		return nil, fmt.Errorf("signature verify failed: %v", err)
+	}
+	if requesterID != uid {
+		auditor, err := holdsRole(ctx, requester.Roles, auditorRole)
+		if err != nil {
+			return nil, err
+		}
+		if !auditor {
+			return nil, fmt.Errorf("permission denied: user %s cannot trace user %s", requesterID, uid)
+		}
+	}
+
+	from, to, err := parseTraceFilter(pageSize, fromTime, toTime)
+	if err != nil {
+		return nil, err
+	}
+
+	it, meta, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(uidLogObjType, []string{uid}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("get uid logs failed: %v", err)
+	}
+	defer it.Close()
+
+	page := &AccessLogPage{Logs: []AccessLog{}, Bookmark: meta.GetBookmark(), Fetched: meta.GetFetchedRecordsCount()}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attrs, err := ctx.GetStub().SplitCompositeKey(kv.Key)
+		if err != nil || len(attrs) != 3 {
+			page.Skipped++
+			continue
+		}
+		txID, cid := attrs[1], attrs[2]
+		b, err := ctx.GetStub().GetState(cid + "_log_" + txID)
+		if err != nil {
+			return nil, fmt.Errorf("get log failed: %v", err)
+		}
+		var entry AccessLog
+		if b == nil || json.Unmarshal(b, &entry) != nil {
+			page.Skipped++
+			continue
+		}
+		if !inTraceWindow(entry.Time, from, to) {
+			continue
+		}
+		entry.CID = cid
+		page.Logs = append(page.Logs, entry)
+	}
+
+	elapsedMs := float64(time.Since(start).Microseconds()) / 1000.0
+	log.Printf("[TraceUser] uid=%s requester=%s fetched=%d logs=%d elapsed=%.3f ms", uid, requesterID, page.Fetched, len(page.Logs), elapsedMs)
+	return page, nil
+}
+
+// TraceUnauthenticated(cid, pageSize, bookmark) 按页读取 cid 上未通过认证的拒绝记录
+// 记录中的 ClaimedUID 未经验证，不能据此认定任何用户发起过请求
+func (s *SmartContract) TraceUnauthenticated(ctx contractapi.TransactionContextInterface, cid string, pageSize int32, bookmark string) (*AccessLogPage, error) {
+	start := time.Now()
+	if _, _, err := parseTraceFilter(pageSize, "", ""); err != nil {
+		return nil, err
+	}
+	it, meta, err := ctx.GetStub().GetStateByPartialCompositeKeyWithPagination(unauthLogObjType, []string{cid}, pageSize, bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("get unauthenticated logs failed: %v", err)
+	}
+	defer it.Close()
+
+	page := &AccessLogPage{Logs: []AccessLog{}, Bookmark: meta.GetBookmark(), Fetched: meta.GetFetchedRecordsCount()}
+	for it.HasNext() {
+		kv, err := it.Next()
+		if err != nil {
+			return nil, err
+		}
+		var entry AccessLog
+		if err := json.Unmarshal(kv.Value, &entry); err != nil {
+			page.Skipped++
+			continue
+		}
+		page.Logs = append(page.Logs, entry)
+	}
+
+	elapsedMs := float64(time.Since(start).Microseconds()) / 1000.0
+	log.Printf("[TraceUnauthenticated] cid=%s fetched=%d logs=%d skipped=%d elapsed=%.3f ms", cid, page.Fetched, len(page.Logs), page.Skipped, elapsedMs)
+	return page, nil
+}
+
+// holdsRole 判断持有角色及其继承的下级角色中是否包含 role
+func holdsRole(ctx contractapi.TransactionContextInterface, held []string, role string) (bool, error) {
+	for _, h := range held {
+		roles, err := effectiveRoles(ctx, h)
+		if err != nil {
+			return false, err
+		}
+		if containsString(roles, role) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// putAccessLog 以 cid_log_txID 为 Key 写入一条日志，每笔交易对每个 cid 只写一条
+// TxID 与 Time 统一取自交易本身；同时写入 uidlog 索引，供 TraceUser 按用户查询
+func putAccessLog(ctx contractapi.TransactionContextInterface, cid string, logEntry AccessLog) error {
 	txID := ctx.GetStub().GetTxID()
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	logEntry.TxID = txID
+	logEntry.Time = now
 	key := cid + "_log_" + txID
-	now := time.Now().UTC()
-	logEntry := AccessLog{
-		UID:      uid,
-		Decision: decision,
-		Time:     now,
+	nb, err := json.Marshal(logEntry)
+	if err != nil {
+		return fmt.Errorf("marshal log failed: %v", err)
+	}
+	if err := ctx.GetStub().PutState(key, nb); err != nil {
+		return err
+	}
+	idxKey, err := ctx.GetStub().CreateCompositeKey(uidLogObjType, []string{logEntry.UID, txID, cid})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
+	}
+	return ctx.GetStub().PutState(idxKey, []byte{0x00})
+}
+
+// putUnauthLog 以 unauthlog 组合键 [cid, txID] 写入一条未通过认证的拒绝记录，不建立 uidlog 索引
+func putUnauthLog(ctx contractapi.TransactionContextInterface, cid string, logEntry AccessLog) error {
+	txID := ctx.GetStub().GetTxID()
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	logEntry.TxID = txID
+	logEntry.Time = now
+	key, err := ctx.GetStub().CreateCompositeKey(unauthLogObjType, []string{cid, txID})
+	if err != nil {
+		return fmt.Errorf("create composite key failed: %v", err)
 	}
 	nb, err := json.Marshal(logEntry)
 	if err != nil {
@@ -0,0 +1,1802 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-chaincode-go/shimtest"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	mspproto "github.com/hyperledger/fabric-protos-go/msp"
+	pb "github.com/hyperledger/fabric-protos-go/peer"
+)
+
+/* ---------- 模拟背书：读只见已提交状态，写集在交易成功后统一提交 ---------- */
+
+type kvIter struct {
+	kvs []*queryresult.KV
+	i   int
+}
+
+func (it *kvIter) HasNext() bool { return it.i < len(it.kvs) }
+func (it *kvIter) Next() (*queryresult.KV, error) {
+	kv := it.kvs[it.i]
+	it.i++
+	return kv, nil
+}
+func (it *kvIter) Close() error { return nil }
+
+// txStub 包装 MockStub：与 Fabric 一致，交易读不到自己的写，失败交易的写集整体丢弃
+type txStub struct {
+	*shimtest.MockStub
+	fn      string
+	params  []string
+	txid    string
+	ts      *timestamp.Timestamp
+	writes  map[string][]byte
+	dels    map[string]bool
+	events  map[string][]byte
+	creator []byte
+}
+
+func (t *txStub) GetFunctionAndParameters() (string, []string) { return t.fn, t.params }
+func (t *txStub) GetStringArgs() []string                      { return append([]string{t.fn}, t.params...) }
+func (t *txStub) GetArgs() [][]byte {
+	var out [][]byte
+	for _, a := range t.GetStringArgs() {
+		out = append(out, []byte(a))
+	}
+	return out
+}
+func (t *txStub) GetTxID() string                               { return t.txid }
+func (t *txStub) GetTxTimestamp() (*timestamp.Timestamp, error) { return t.ts, nil }
+func (t *txStub) GetState(k string) ([]byte, error)             { return t.MockStub.State[k], nil }
+func (t *txStub) PutState(k string, v []byte) error {
+	if k == "" {
+		return fmt.Errorf("empty key")
+	}
+	t.writes[k] = v
+	delete(t.dels, k)
+	return nil
+}
+func (t *txStub) DelState(k string) error {
+	t.dels[k] = true
+	delete(t.writes, k)
+	return nil
+}
+func (t *txStub) SetEvent(n string, p []byte) error { t.events[n] = p; return nil }
+func (t *txStub) GetCreator() ([]byte, error)       { return t.creator, nil }
+
+func collect(it shim.StateQueryIteratorInterface) []*queryresult.KV {
+	var out []*queryresult.KV
+	for it.HasNext() {
+		kv, _ := it.Next()
+		out = append(out, kv)
+	}
+	it.Close()
+	return out
+}
+
+func paginate(kvs []*queryresult.KV, pageSize int32, bookmark string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	start := 0
+	if bookmark != "" {
+		for start < len(kvs) && kvs[start].Key < bookmark {
+			start++
+		}
+	}
+	end := start + int(pageSize)
+	next := ""
+	if end < len(kvs) {
+		next = kvs[end].Key
+	} else {
+		end = len(kvs)
+	}
+	return &kvIter{kvs: kvs[start:end]}, &pb.QueryResponseMetadata{FetchedRecordsCount: int32(end - start), Bookmark: next}, nil
+}
+
+func (t *txStub) GetStateByRangeWithPagination(s, e string, ps int32, bm string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	it, err := t.MockStub.GetStateByRange(s, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return paginate(collect(it), ps, bm)
+}
+
+func (t *txStub) GetStateByPartialCompositeKeyWithPagination(o string, k []string, ps int32, bm string) (shim.StateQueryIteratorInterface, *pb.QueryResponseMetadata, error) {
+	it, err := t.MockStub.GetStateByPartialCompositeKey(o, k)
+	if err != nil {
+		return nil, nil, err
+	}
+	return paginate(collect(it), ps, bm)
+}
+
+// creatorFor 生成带 Fabric CA 属性扩展的自签名客户端证书，按属性集合缓存
+var creators = map[string][]byte{}
+
+func creatorFor(attrs map[string]string) []byte {
+	attrJSON, _ := json.Marshal(map[string]interface{}{"attrs": attrs})
+	if c, ok := creators[string(attrJSON)]; ok {
+		return c
+	}
+	priv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber:    big.NewInt(1),
+		NotBefore:       time.Unix(0, 0),
+		NotAfter:        time.Unix(1<<33, 0),
+		ExtraExtensions: []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 2, 3, 4, 5, 6, 7, 8, 1}, Value: attrJSON}},
+	}
+	der, _ := x509.CreateCertificate(rand.Reader, tmpl, tmpl, priv.Public(), priv)
+	b, _ := proto.Marshal(&mspproto.SerializedIdentity{Mspid: "Org1MSP", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})})
+	creators[string(attrJSON)] = b
+	return b
+}
+
+// ledger 按顺序执行交易，每笔交易时间戳递增一秒
+type ledger struct {
+	t    *testing.T
+	cc   *contractapi.ContractChaincode
+	mock *shimtest.MockStub
+	n    int
+	now  time.Time
+	last *txStub
+	// attrs 为提交者客户端证书的属性，默认是可注册任意角色的运营方身份
+	attrs  map[string]string
+	events []map[string][]byte
+}
+
+func newLedger(t *testing.T) *ledger {
+	cc, err := contractapi.NewChaincode(new(SmartContract))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &ledger{
+		t:     t,
+		cc:    cc,
+		mock:  shimtest.NewMockStub("acmc", cc),
+		now:   time.Unix(1700000000, 0),
+		attrs: map[string]string{registrarAttr: "true", bootstrapAttr: "true"},
+	}
+}
+
+func (l *ledger) invoke(fn string, args ...string) (string, error) {
+	l.n++
+	l.now = l.now.Add(time.Second)
+	st := &txStub{
+		MockStub: l.mock,
+		fn:       fn,
+		params:   args,
+		txid:     fmt.Sprintf("tx%04d", l.n),
+		ts:       &timestamp.Timestamp{Seconds: l.now.Unix()},
+		writes:   map[string][]byte{},
+		dels:     map[string]bool{},
+		events:   map[string][]byte{},
+		creator:  creatorFor(l.attrs),
+	}
+	l.last = st
+	resp := l.cc.Invoke(st)
+	if resp.Status != shim.OK {
+		return "", fmt.Errorf("%s", resp.Message)
+	}
+	keys := make([]string, 0, len(st.writes))
+	for k := range st.writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	l.mock.MockTransactionStart(st.txid)
+	for _, k := range keys {
+		l.mock.PutState(k, st.writes[k])
+	}
+	for k := range st.dels {
+		l.mock.DelState(k)
+	}
+	l.mock.MockTransactionEnd(st.txid)
+	// 每笔改变状态的交易恰好发出一条事件
+	if (len(st.writes) > 0 || len(st.dels) > 0) && len(st.events) != 1 {
+		l.t.Errorf("%s wrote state but emitted %d events", fn, len(st.events))
+	}
+	l.events = append(l.events, st.events)
+	return string(resp.Payload), nil
+}
+
+// seed 直接写入已提交状态，用于构造旧版链码留下的数据
+func (l *ledger) seed(k string, v interface{}) {
+	l.mock.MockTransactionStart("seed")
+	l.mock.PutState(k, []byte(js(v)))
+	l.mock.MockTransactionEnd("seed")
+}
+
+func (l *ledger) must(fn string, args ...string) string {
+	l.t.Helper()
+	out, err := l.invoke(fn, args...)
+	if err != nil {
+		l.t.Fatalf("%s%v: %v", fn, args, err)
+	}
+	return out
+}
+
+func (l *ledger) fail(fn string, args ...string) string {
+	l.t.Helper()
+	_, err := l.invoke(fn, args...)
+	if err == nil {
+		l.t.Fatalf("%s%v: expected error", fn, args)
+	}
+	return err.Error()
+}
+
+// mustS / failS 以 k 的签名凭据作为第一个参数调用 fn(args...)
+func (l *ledger) mustS(k *key, fn string, args ...string) string {
+	l.t.Helper()
+	return l.must(fn, append([]string{k.proof(fn, args...)}, args...)...)
+}
+
+func (l *ledger) failS(k *key, fn string, args ...string) string {
+	l.t.Helper()
+	return l.fail(fn, append([]string{k.proof(fn, args...)}, args...)...)
+}
+
+// expectDecision 提交 k 签名的 CheckPerm 并校验结论
+func (l *ledger) expectDecision(k *key, operation, cid, want string) {
+	l.t.Helper()
+	if d := l.mustS(k, "CheckPerm", operation, k.id, cid); d != want {
+		l.t.Fatalf("CheckPerm(%s, %s) = %s, want %s", operation, cid, d, want)
+	}
+}
+
+/* ---------- 测试用户密钥 ---------- */
+
+type key struct {
+	priv *rsa.PrivateKey
+	pem  string
+	id   string
+}
+
+func newKey() *key {
+	priv, _ := rsa.GenerateKey(rand.Reader, 1024)
+	der, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	h := sha256.Sum256(der)
+	return &key{priv: priv, pem: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), id: fmt.Sprintf("%x", h)}
+}
+
+func (k *key) signBytes(data []byte) string {
+	sum := sha256.Sum256(data)
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, k.priv, crypto.SHA256, sum[:])
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+var nonceN int
+
+// proofExpiry 为测试凭据的统一过期时间，从起始时间算起恰为 maxProofTTL，覆盖整个测试时间线
+const proofExpiry = int64(1700000000 + maxProofTTL)
+
+// proof 生成对 fn(args...) 的凭据，nonce 全局递增
+func (k *key) proof(fn string, args ...string) string {
+	nonceN++
+	n := fmt.Sprintf("n%d", nonceN)
+	exp := proofExpiry
+	return js(SignedProof{Nonce: n, Expiry: exp, Signature: k.signBytes(canonicalPayload(fn, args, n, exp))})
+}
+
+func js(v interface{}) string { b, _ := json.Marshal(v); return string(b) }
+
+/* ---------- 背书确定性 ---------- */
+
+// 两个背书节点在不同的本地时间模拟同一提案，写集与事件必须逐字节一致
+func TestEndorsementDeterminism(t *testing.T) {
+	alice, bob := newKey(), newKey()
+	addProof := alice.proof("AddResource", alice.id, "Q")
+	permProof := alice.proof("AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+	checkProof := bob.proof("CheckPerm", "download", bob.id, "Q")
+
+	type result struct{ writes, events []map[string][]byte }
+	run := func() result {
+		l := newLedger(t)
+		var r result
+		step := func(fn string, args ...string) {
+			l.must(fn, args...)
+			r.writes = append(r.writes, l.last.writes)
+			r.events = append(r.events, l.last.events)
+		}
+		step("Register", alice.id, alice.pem, "Creator")
+		step("Register", bob.id, bob.pem, "Public")
+		step("AddResource", addProof, alice.id, "Q")
+		step("AddPerm", permProof, alice.id, "Q", "download", js([]string{"Public"}), "", "")
+		step("CheckPerm", checkProof, "download", bob.id, "Q")
+		return r
+	}
+	a := run()
+	time.Sleep(20 * time.Millisecond)
+	b := run()
+	if js(a.writes) != js(b.writes) {
+		t.Fatalf("write sets differ:\n%s\n%s", js(a.writes), js(b.writes))
+	}
+	if js(a.events) != js(b.events) {
+		t.Fatalf("events differ:\n%s\n%s", js(a.events), js(b.events))
+	}
+}
+
+/* ---------- RevokePerm ---------- */
+
+func TestRevokePerm(t *testing.T) {
+	l := newLedger(t)
+	alice, bob, eve := newKey(), newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.must("Register", eve.id, eve.pem, "Creator")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public", "Creator"}), "", "")
+	l.expectDecision(bob, "download", "Q", "Permit")
+
+	l.failS(eve, "RevokePerm", eve.id, "Q", "download", js([]string{"Public"}))
+	l.failS(alice, "RevokePerm", alice.id, "Q", "upload", js([]string{"Public"}))
+	l.mustS(alice, "RevokePerm", alice.id, "Q", "download", js([]string{"Public"}))
+	l.expectDecision(bob, "download", "Q", "Deny")
+	// 其余角色的授权不受影响
+	l.expectDecision(alice, "download", "Q", "Permit")
+
+	var logs []AccessLog
+	json.Unmarshal([]byte(l.must("TraceCid", "Q")), &logs)
+	revokes := 0
+	for _, e := range logs {
+		if e.Decision == "Revoke" {
+			revokes++
+			if e.UID != alice.id || js(e.Roles) != `["Public"]` {
+				t.Fatalf("unexpected revoke log %+v", e)
+			}
+		}
+	}
+	if revokes != 1 {
+		t.Fatalf("revoke logs = %d, want 1", revokes)
+	}
+}
+
+/* ---------- 初始化与动态角色 ---------- */
+
+// setupAdmin 注册管理员并以运营方身份执行 InitLedger
+func setupAdmin(l *ledger) *key {
+	admin := newKey()
+	l.must("Register", admin.id, admin.pem, "Creator")
+	l.must("InitLedger", js([]string{admin.id}), "false")
+	return admin
+}
+
+func TestInitLedgerRequiresBootstrapIdentity(t *testing.T) {
+	l := newLedger(t)
+	admin, mallory := newKey(), newKey()
+	l.must("Register", admin.id, admin.pem, "Creator")
+	l.attrs = map[string]string{registrarAttr: "true"}
+	if e := l.fail("InitLedger", js([]string{mallory.id}), "true"); !strings.Contains(e, bootstrapAttr) {
+		t.Fatal(e)
+	}
+	l.attrs = map[string]string{bootstrapAttr: "true"}
+	l.fail("InitLedger", "[]", "false")
+	l.must("InitLedger", js([]string{admin.id}), "false")
+	l.fail("InitLedger", js([]string{admin.id}), "false")
+}
+
+// 抢先注册的用户不能阻止 InitLedger，但列出的管理员必须已注册
+func TestInitLedgerRequiresRegisteredAdmins(t *testing.T) {
+	l := newLedger(t)
+	admin, alice, ghost := newKey(), newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Public")
+	l.must("Register", admin.id, admin.pem, "Public")
+	if e := l.fail("InitLedger", js([]string{admin.id, ghost.id}), "false"); !strings.Contains(e, "not registered") {
+		t.Fatal(e)
+	}
+	l.must("InitLedger", js([]string{admin.id}), "false")
+	l.failS(alice, "AddRole", alice.id, "Reviewer")
+	l.mustS(admin, "AddRole", admin.id, "Reviewer")
+}
+
+func TestRoleManagement(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+
+	l.failS(bob, "AddRole", bob.id, "Reviewer")
+	l.failS(admin, "AddRole", admin.id, "")
+	l.failS(admin, "AddRole", admin.id, "Public")
+	l.mustS(admin, "AddRole", admin.id, "Reviewer")
+	if out := l.must("ListRoles"); out != `["Creator","Contributor","Public","Reviewer"]` {
+		t.Fatal(out)
+	}
+	// 被授权引用或被用户持有的角色不能删除
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Reviewer"}), "", "")
+	l.failS(admin, "RemoveRole", admin.id, "Reviewer")
+	l.mustS(alice, "RevokePerm", alice.id, "Q", "download", js([]string{"Reviewer"}))
+	l.mustS(admin, "AssignRole", admin.id, bob.id, "Reviewer")
+	l.failS(admin, "RemoveRole", admin.id, "Reviewer")
+	l.mustS(admin, "UnassignRole", admin.id, bob.id, "Reviewer")
+	// 拒绝规则同样引用角色，否则同名角色重建后旧规则会重新生效
+	l.mustS(alice, "AddDenyRule", alice.id, "Q", "download", "role:Reviewer")
+	if e := l.failS(admin, "RemoveRole", admin.id, "Reviewer"); !strings.Contains(e, "deny rules") {
+		t.Fatal(e)
+	}
+	l.mustS(alice, "RemoveDenyRule", alice.id, "Q", "download", "role:Reviewer")
+	l.failS(bob, "RemoveRole", bob.id, "Reviewer")
+	l.mustS(admin, "RemoveRole", admin.id, "Reviewer")
+	l.failS(admin, "RemoveRole", admin.id, "Reviewer")
+	if out := l.must("ListRoles"); strings.Contains(out, "Reviewer") {
+		t.Fatal(out)
+	}
+}
+
+// 全局状态使用组合键，用户抢先以同名 cid 或 userID 注册资源都无法覆盖或伪造它们
+func TestReservedStateKeys(t *testing.T) {
+	l := newLedger(t)
+	for objType, k := range map[string]string{"config": configKey, "roleIndexComplete": roleIndexKey} {
+		if ck, _ := l.mock.CreateCompositeKey(objType, nil); ck != k {
+			t.Fatalf("%q != %q", k, ck)
+		}
+	}
+	legacy, alice := newKey(), newKey()
+	l.seed(roleSetKeyPrefix, []string{"Creator", "Contributor", "Public", "Reviewer"})
+	l.seed(legacy.id, map[string]string{"pk": legacy.pem, "role": "Reviewer"})
+	l.must("Register", alice.id, alice.pem, "Creator")
+	for _, cid := range []string{configKey, roleIndexKey, roleSetKeyPrefix, ""} {
+		l.failS(alice, "AddResource", alice.id, cid)
+	}
+	l.mustS(alice, "AddResource", alice.id, "config")
+	l.mustS(alice, "AddResource", alice.id, "roleIndexComplete")
+
+	admin := setupAdmin(l)
+	if e := l.failS(admin, "RemoveRole", admin.id, "Reviewer"); !strings.Contains(e, "BackfillRoleIndex") {
+		t.Fatal(e)
+	}
+}
+
+// 旧版链码写入的单角色用户没有 role~uid 索引，迁移完成前 RemoveRole 必须拒绝
+func TestRemoveRoleWithLegacyUsers(t *testing.T) {
+	l := newLedger(t)
+	legacy := newKey()
+	l.seed(roleSetKeyPrefix, []string{"Creator", "Contributor", "Public", "Reviewer"})
+	l.seed(legacy.id, map[string]string{"pk": legacy.pem, "role": "Reviewer"})
+	admin := setupAdmin(l)
+
+	if e := l.failS(admin, "RemoveRole", admin.id, "Reviewer"); !strings.Contains(e, "BackfillRoleIndex") {
+		t.Fatal(e)
+	}
+	l.failS(legacy, "BackfillRoleIndex", legacy.id, js([]string{legacy.id}), "true")
+	l.failS(admin, "BackfillRoleIndex", admin.id, js([]string{"ghost"}), "true")
+	l.mustS(admin, "BackfillRoleIndex", admin.id, js([]string{legacy.id}), "true")
+	if out := l.must("QueryUserID", legacy.id); !strings.Contains(out, `"roles":["Reviewer"]`) {
+		t.Fatal(out)
+	}
+	if e := l.failS(admin, "RemoveRole", admin.id, "Reviewer"); !strings.Contains(e, "still assigned") {
+		t.Fatal(e)
+	}
+	l.mustS(admin, "UnassignRole", admin.id, legacy.id, "Reviewer")
+	l.mustS(admin, "RemoveRole", admin.id, "Reviewer")
+}
+
+/* ---------- 角色继承 ---------- */
+
+func TestRoleInheritance(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice, bob, carol := newKey(), newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Contributor")
+	l.must("Register", carol.id, carol.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "upload", js([]string{"Contributor"}), "", "")
+
+	// 默认继承链 Creator ⊇ Contributor ⊇ Public
+	l.expectDecision(alice, "download", "Q", "Permit")
+	l.expectDecision(bob, "download", "Q", "Permit")
+	l.expectDecision(bob, "upload", "Q", "Permit")
+	l.expectDecision(carol, "upload", "Q", "Deny")
+
+	// 成环、自环与未知角色均拒绝
+	l.failS(admin, "AddRoleInheritance", admin.id, "Public", "Creator")
+	l.failS(admin, "AddRoleInheritance", admin.id, "Public", "Public")
+	l.failS(admin, "AddRoleInheritance", admin.id, "Nope", "Public")
+	l.failS(bob, "AddRoleInheritance", bob.id, "Public", "Contributor")
+
+	l.mustS(admin, "RemoveRoleInheritance", admin.id, "Contributor", "Public")
+	l.failS(admin, "RemoveRoleInheritance", admin.id, "Contributor", "Public")
+	l.expectDecision(bob, "download", "Q", "Deny")
+	l.expectDecision(alice, "download", "Q", "Deny")
+
+	l.mustS(admin, "AddRole", admin.id, "Auditor")
+	l.mustS(admin, "AddRoleInheritance", admin.id, "Auditor", "Public")
+	l.mustS(admin, "AssignRole", admin.id, bob.id, "Auditor")
+	l.expectDecision(bob, "download", "Q", "Permit")
+
+	var edges []RoleEdge
+	json.Unmarshal([]byte(l.must("ListRoleInheritance")), &edges)
+	if js(edges) != js([]RoleEdge{{Senior: "Auditor", Junior: "Public"}, {Senior: "Creator", Junior: "Contributor"}}) {
+		t.Fatal(js(edges))
+	}
+}
+
+/* ---------- 多角色 ---------- */
+
+func TestAssignAndUnassignRole(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(admin, "AddRole", admin.id, "Reviewer")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Reviewer"}), "", "")
+	l.expectDecision(bob, "download", "Q", "Deny")
+
+	l.failS(bob, "AssignRole", bob.id, bob.id, "Reviewer")
+	l.failS(admin, "AssignRole", admin.id, bob.id, "Nope")
+	l.mustS(admin, "AssignRole", admin.id, bob.id, "Reviewer")
+	l.failS(admin, "AssignRole", admin.id, bob.id, "Reviewer")
+	if out := l.must("QueryUserID", bob.id); !strings.Contains(out, `"roles":["Public","Reviewer"]`) {
+		t.Fatal(out)
+	}
+	l.expectDecision(bob, "download", "Q", "Permit")
+
+	l.mustS(admin, "UnassignRole", admin.id, bob.id, "Reviewer")
+	l.failS(admin, "UnassignRole", admin.id, bob.id, "Reviewer")
+	l.expectDecision(bob, "download", "Q", "Deny")
+}
+
+// 旧版用户第一次被改写时补写全部角色的索引，RemoveRole 不会漏掉其原有角色
+func TestAssignRoleBackfillsLegacyIndex(t *testing.T) {
+	l := newLedger(t)
+	legacy := newKey()
+	l.seed(roleSetKeyPrefix, []string{"Creator", "Contributor", "Public", "Reviewer"})
+	l.seed(legacy.id, map[string]string{"pk": legacy.pem, "role": "Reviewer"})
+	admin := setupAdmin(l)
+
+	l.mustS(admin, "AssignRole", admin.id, legacy.id, "Contributor")
+	for _, role := range []string{"Reviewer", "Contributor"} {
+		idx, _ := l.mock.CreateCompositeKey(roleUserObjType, []string{role, legacy.id})
+		if _, ok := l.mock.State[idx]; !ok {
+			t.Fatalf("missing role~uid index for %s", role)
+		}
+	}
+	if out := l.must("QueryUserID", legacy.id); strings.Contains(out, `"role":`) {
+		t.Fatal(out)
+	}
+	l.mustS(admin, "BackfillRoleIndex", admin.id, "[]", "true")
+	l.failS(admin, "RemoveRole", admin.id, "Reviewer")
+	l.mustS(admin, "UnassignRole", admin.id, legacy.id, "Reviewer")
+	l.mustS(admin, "RemoveRole", admin.id, "Reviewer")
+}
+
+/* ---------- 签名凭据 ---------- */
+
+func TestProofBindsCallAndNonce(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+
+	grant := []string{alice.id, "Q", "download", js([]string{"Public"}), "", ""}
+	p := alice.proof("AddPerm", grant...)
+	// 参数或函数名不同均验签失败，且被拒绝的凭据不登记 nonce
+	l.fail("AddPerm", p, alice.id, "Q", "upload", js([]string{"Public"}), "", "")
+	l.fail("RevokePerm", p, alice.id, "Q", "download", js([]string{"Public"}))
+	l.must("AddPerm", append([]string{p}, grant...)...)
+	if e := l.fail("AddPerm", append([]string{p}, grant...)...); !strings.Contains(e, "nonce") {
+		t.Fatal(e)
+	}
+	// 他人的签名不能冒用
+	l.fail("AddPerm", append([]string{bob.proof("AddPerm", grant...)}, grant...)...)
+
+	expired := SignedProof{Nonce: "expired", Expiry: 1700000001}
+	expired.Signature = alice.signBytes(canonicalPayload("AddPerm", grant, expired.Nonce, expired.Expiry))
+	if e := l.fail("AddPerm", append([]string{js(expired)}, grant...)...); !strings.Contains(e, "expired") {
+		t.Fatal(e)
+	}
+	l.fail("AddPerm", append([]string{"not json"}, grant...)...)
+
+	// 有效期不能超过 maxProofTTL，否则 nonce 永远无法清理
+	distant := SignedProof{Nonce: "distant", Expiry: l.now.Unix() + maxProofTTL + 10}
+	distant.Signature = alice.signBytes(canonicalPayload("AddPerm", grant, distant.Nonce, distant.Expiry))
+	if e := l.fail("AddPerm", append([]string{js(distant)}, grant...)...); !strings.Contains(e, "seconds ahead") {
+		t.Fatal(e)
+	}
+}
+
+// countNonces 返回已提交状态中 nonce 记录的数量
+func countNonces(l *ledger) int {
+	n := 0
+	for k := range l.mock.State {
+		if strings.HasPrefix(k, "\x00"+nonceObjType+"\x00") {
+			n++
+		}
+	}
+	return n
+}
+
+func TestPurgeExpiredNonces(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice := newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	grant := []string{alice.id, "Q", "download", js([]string{"Public"}), "", ""}
+	short := SignedProof{Nonce: "short", Expiry: l.now.Unix() + 10}
+	short.Signature = alice.signBytes(canonicalPayload("AddPerm", grant, short.Nonce, short.Expiry))
+	l.must("AddPerm", append([]string{js(short)}, grant...)...)
+	if n := countNonces(l); n != 2 {
+		t.Fatalf("nonces = %d, want 2", n)
+	}
+
+	l.failS(alice, "PurgeExpiredNonces", alice.id)
+	// 未过期的 nonce 不删除
+	if out := l.mustS(admin, "PurgeExpiredNonces", admin.id); out != "0" {
+		t.Fatal(out)
+	}
+	l.now = l.now.Add(time.Minute)
+	if out := l.mustS(admin, "PurgeExpiredNonces", admin.id); out != "1" {
+		t.Fatal(out)
+	}
+	if n := countNonces(l); n != 3 {
+		t.Fatalf("nonces = %d, want 3", n)
+	}
+	// 删除后过期凭据仍因 expiry 被拒绝
+	if e := l.fail("AddPerm", append([]string{js(short)}, grant...)...); !strings.Contains(e, "expired") {
+		t.Fatal(e)
+	}
+}
+
+func TestCanonicalPayloadIsUnambiguous(t *testing.T) {
+	a := canonicalPayload("F", []string{"a,b", "c"}, "n", 1)
+	b := canonicalPayload("F", []string{"a", "b,c"}, "n", 1)
+	if string(a) == string(b) {
+		t.Fatalf("payloads collide: %q", a)
+	}
+}
+
+/* ---------- 压测模式 ---------- */
+
+func TestTestModeRequiresBootstrapIdentity(t *testing.T) {
+	alice := newKey()
+	static := alice.signBytes([]byte(alice.id))
+
+	// 未初始化的账本不接受静态签名
+	l := newLedger(t)
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.fail("AddResource", static, alice.id, "Q1")
+
+	// 抢先调用 InitLedger 的普通客户端不能开启压测模式
+	l.attrs = map[string]string{registrarAttr: "true"}
+	l.fail("InitLedger", js([]string{alice.id}), "true")
+	l.fail("AddResource", static, alice.id, "Q1")
+
+	l.attrs = map[string]string{bootstrapAttr: "true"}
+	l.must("InitLedger", js([]string{alice.id}), "true")
+	l.must("AddResource", static, alice.id, "Q1")
+	l.mustS(alice, "AddResource", alice.id, "Q2")
+	l.fail("InitLedger", js([]string{alice.id}), "false")
+	if cfg := string(l.mock.State[configKey]); !strings.Contains(cfg, `"initializedBy":"Org1MSP/`) {
+		t.Fatal(cfg)
+	}
+
+	// 正式部署只接受绑定 cid 的凭据
+	l2 := newLedger(t)
+	l2.must("Register", alice.id, alice.pem, "Creator")
+	l2.must("InitLedger", js([]string{alice.id}), "false")
+	l2.fail("AddResource", static, alice.id, "Q1")
+	l2.fail("AddResource", alice.proof("AddResource", alice.id, "Q2"), alice.id, "Q1")
+}
+
+/* ---------- 属主转移 ---------- */
+
+func queryResource(t *testing.T, l *ledger, cid string) Resource {
+	t.Helper()
+	var res Resource
+	if err := json.Unmarshal([]byte(l.must("QueryCid", cid)), &res); err != nil {
+		t.Fatal(err)
+	}
+	return res
+}
+
+func TestOwnershipTransfer(t *testing.T) {
+	l := newLedger(t)
+	alice, bob, eve := newKey(), newKey(), newKey()
+	for _, k := range []*key{alice, bob, eve} {
+		l.must("Register", k.id, k.pem, "Creator")
+	}
+	l.mustS(alice, "AddResource", alice.id, "Q")
+
+	l.failS(bob, "OfferOwnership", bob.id, "Q", eve.id)
+	l.failS(alice, "OfferOwnership", alice.id, "Q", alice.id)
+	l.failS(alice, "OfferOwnership", alice.id, "Q", "ghost")
+	l.failS(bob, "AcceptOwnership", bob.id, "Q")
+
+	// 撤回后原接收方不能再接受
+	l.mustS(alice, "OfferOwnership", alice.id, "Q", eve.id)
+	l.mustS(alice, "CancelOwnershipOffer", alice.id, "Q")
+	l.failS(eve, "AcceptOwnership", eve.id, "Q")
+
+	l.mustS(alice, "OfferOwnership", alice.id, "Q", bob.id)
+	if res := queryResource(t, l, "Q"); res.OwnerUID != alice.id || res.PendingOwnerUID != bob.id {
+		t.Fatalf("%+v", res)
+	}
+	l.failS(eve, "AcceptOwnership", eve.id, "Q")
+	l.mustS(bob, "AcceptOwnership", bob.id, "Q")
+
+	res := queryResource(t, l, "Q")
+	if res.OwnerUID != bob.id || res.PendingOwnerUID != "" || len(res.Transfers) != 1 {
+		t.Fatalf("%+v", res)
+	}
+	if tr := res.Transfers[0]; tr.FromUID != alice.id || tr.ToUID != bob.id || tr.Time.IsZero() {
+		t.Fatalf("%+v", tr)
+	}
+	l.failS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+	l.mustS(bob, "AddPerm", bob.id, "Q", "download", js([]string{"Public"}), "", "")
+}
+
+/* ---------- 删除资源 ---------- */
+
+func TestRemoveResource(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddResource", alice.id, "Q2")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public", "Creator"}), "", "")
+	l.mustS(alice, "AddPerm", alice.id, "Q2", "download", js([]string{"Public"}), "", "")
+	l.expectDecision(bob, "download", "Q", "Permit")
+
+	l.failS(bob, "RemoveResource", bob.id, "Q")
+	l.mustS(alice, "RemoveResource", alice.id, "Q")
+	l.failS(alice, "RemoveResource", alice.id, "Q")
+	l.expectDecision(bob, "download", "Q", "Deny")
+	l.expectDecision(bob, "download", "Q2", "Permit")
+
+	// 墓碑保留记录，cid 不能再被注册或授权
+	if res := queryResource(t, l, "Q"); res.Tombstone == nil || res.Tombstone.RemovedBy != alice.id {
+		t.Fatalf("%+v", res)
+	}
+	l.failS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+	l.failS(alice, "AddResource", alice.id, "Q")
+	for k := range l.mock.State {
+		if strings.HasPrefix(k, "\x00"+policyObjType+"\x00") && strings.Contains(k, "\x00Q\x00") {
+			t.Fatalf("policy entry left behind: %q", k)
+		}
+	}
+
+	var logs []AccessLog
+	json.Unmarshal([]byte(l.must("TraceCid", "Q")), &logs)
+	if last := logs[len(logs)-1]; last.Reason != denyReasonResourceRemoved {
+		t.Fatalf("%+v", last)
+	}
+}
+
+/* ---------- 授权有效期 ---------- */
+
+func TestGrantWindow(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddResource", alice.id, "Q2")
+	l.failS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "2023-11-15T00:00:00Z", "2023-11-14T00:00:00Z")
+	l.failS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "bad", "")
+
+	// 测试账本从 2023-11-14T22:13:20Z 起每笔交易推进一秒
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "2023-11-14T22:13:40Z")
+	l.mustS(alice, "AddPerm", alice.id, "Q2", "download", js([]string{"Public"}), "2023-11-14T22:13:40Z", "")
+	l.expectDecision(bob, "download", "Q", "Permit")
+	l.expectDecision(bob, "download", "Q2", "Deny")
+	for i := 0; i < 20; i++ {
+		l.must("ListRoles")
+	}
+	l.expectDecision(bob, "download", "Q", "Deny")
+	l.expectDecision(bob, "download", "Q2", "Permit")
+
+	var logs []AccessLog
+	json.Unmarshal([]byte(l.must("TraceCid", "Q")), &logs)
+	if last := logs[len(logs)-1]; last.Reason != denyReasonGrantExpired {
+		t.Fatalf("%+v", last)
+	}
+	json.Unmarshal([]byte(l.must("TraceCid", "Q2")), &logs)
+	if first := logs[0]; first.Reason != denyReasonGrantNotYet {
+		t.Fatalf("%+v", first)
+	}
+}
+
+// 旧版授权的值为 0x01，表示不限期
+func TestLegacyPolicyEntryIsUnbounded(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	k, _ := l.mock.CreateCompositeKey(policyObjType, []string{"Public", "Q", "download"})
+	l.mock.MockTransactionStart("seed")
+	l.mock.PutState(k, []byte{0x01})
+	l.mock.MockTransactionEnd("seed")
+	l.expectDecision(bob, "download", "Q", "Permit")
+}
+
+/* ---------- 拒绝规则 ---------- */
+
+func TestDenyRules(t *testing.T) {
+	l := newLedger(t)
+	alice, bob, carol := newKey(), newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.must("Register", carol.id, carol.pem, "Creator")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+
+	l.failS(bob, "AddDenyRule", bob.id, "Q", "download", "user:"+bob.id)
+	for _, bad := range []string{"bogus", "role:Nope", "user:nobody"} {
+		l.failS(alice, "AddDenyRule", alice.id, "Q", "download", bad)
+	}
+	l.mustS(alice, "AddDenyRule", alice.id, "Q", "download", "user:"+bob.id)
+	l.expectDecision(bob, "download", "Q", "Deny")
+	l.expectDecision(carol, "download", "Q", "Permit")
+
+	// 角色规则只匹配直接持有者，Creator 的规则不影响 Public 用户
+	l.mustS(alice, "AddDenyRule", alice.id, "Q", "download", "role:Creator")
+	l.expectDecision(carol, "download", "Q", "Deny")
+
+	var logs []AccessLog
+	json.Unmarshal([]byte(l.must("TraceCid", "Q")), &logs)
+	if last := logs[len(logs)-1]; last.Reason != denyReasonDenyRule || last.Rule != "role:Creator" {
+		t.Fatalf("%+v", last)
+	}
+
+	l.mustS(alice, "RemoveDenyRule", alice.id, "Q", "download", "user:"+bob.id)
+	l.failS(alice, "RemoveDenyRule", alice.id, "Q", "download", "user:"+bob.id)
+	l.expectDecision(bob, "download", "Q", "Permit")
+
+	l.mustS(alice, "RemoveResource", alice.id, "Q")
+	for k := range l.mock.State {
+		if strings.HasPrefix(k, "\x00"+denyObjType+"\x00") {
+			t.Fatalf("deny rule left behind: %q", k)
+		}
+	}
+}
+
+/* ---------- 用户直接授权 ---------- */
+
+func TestUserGrants(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.failS(alice, "GrantUserPerm", alice.id, "Q", "download", "nobody", "", "")
+	l.failS(bob, "GrantUserPerm", bob.id, "Q", "download", bob.id, "", "")
+	l.expectDecision(bob, "download", "Q", "Deny")
+
+	l.mustS(alice, "GrantUserPerm", alice.id, "Q", "download", bob.id, "", "")
+	l.expectDecision(bob, "download", "Q", "Permit")
+	var logs []AccessLog
+	json.Unmarshal([]byte(l.must("TraceCid", "Q")), &logs)
+	if last := logs[len(logs)-1]; last.GrantType != grantTypeUser {
+		t.Fatalf("%+v", last)
+	}
+
+	// 拒绝规则优先于用户授权
+	l.mustS(alice, "AddDenyRule", alice.id, "Q", "download", "user:"+bob.id)
+	l.expectDecision(bob, "download", "Q", "Deny")
+	l.mustS(alice, "RemoveDenyRule", alice.id, "Q", "download", "user:"+bob.id)
+
+	l.mustS(alice, "RevokeUserPerm", alice.id, "Q", "download", bob.id)
+	l.failS(alice, "RevokeUserPerm", alice.id, "Q", "download", bob.id)
+	l.expectDecision(bob, "download", "Q", "Deny")
+
+	// 过期的用户授权不妨碍角色授权生效
+	l.mustS(alice, "GrantUserPerm", alice.id, "Q", "download", bob.id, "", "2023-11-14T22:13:20Z")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+	l.expectDecision(bob, "download", "Q", "Permit")
+
+	l.mustS(alice, "RemoveResource", alice.id, "Q")
+	for k := range l.mock.State {
+		if strings.HasPrefix(k, "\x00"+userPolicyObjType+"\x00") {
+			t.Fatalf("user grant left behind: %q", k)
+		}
+	}
+}
+
+/* ---------- 委派管理员 ---------- */
+
+func TestResourceAdmins(t *testing.T) {
+	l := newLedger(t)
+	alice, bob, carol, dan := newKey(), newKey(), newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	for _, k := range []*key{bob, carol, dan} {
+		l.must("Register", k.id, k.pem, "Public")
+	}
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.failS(bob, "AddPerm", bob.id, "Q", "download", js([]string{"Public"}), "", "")
+	l.failS(bob, "AddResourceAdmin", bob.id, "Q", carol.id, "false")
+
+	l.mustS(alice, "AddResourceAdmin", alice.id, "Q", bob.id, "false")
+	l.mustS(bob, "AddPerm", bob.id, "Q", "download", js([]string{"Public"}), "", "")
+	l.mustS(bob, "AddDenyRule", bob.id, "Q", "download", "user:"+dan.id)
+	// 未获委派权的管理员不能继续委派，也不能删除资源或转移属主
+	l.failS(bob, "AddResourceAdmin", bob.id, "Q", carol.id, "false")
+	l.failS(bob, "RemoveResource", bob.id, "Q")
+	l.failS(bob, "OfferOwnership", bob.id, "Q", carol.id)
+
+	l.mustS(alice, "AddResourceAdmin", alice.id, "Q", bob.id, "true")
+	l.mustS(bob, "AddResourceAdmin", bob.id, "Q", carol.id, "false")
+	l.mustS(carol, "RevokePerm", carol.id, "Q", "download", js([]string{"Public"}))
+	l.failS(carol, "RemoveResourceAdmin", carol.id, "Q", bob.id)
+	// 委派管理员不能通过重复添加接管属主任命的管理员
+	l.mustS(alice, "AddResourceAdmin", alice.id, "Q", dan.id, "true")
+	l.failS(bob, "AddResourceAdmin", bob.id, "Q", dan.id, "false")
+	l.failS(bob, "RemoveResourceAdmin", bob.id, "Q", dan.id)
+	l.mustS(alice, "AddResourceAdmin", alice.id, "Q", carol.id, "true")
+	if res := queryResource(t, l, "Q"); res.Admins[1].AddedBy != bob.id || !res.Admins[1].CanDelegate || res.Admins[2].AddedBy != alice.id {
+		t.Fatalf("%+v", res.Admins)
+	}
+	l.mustS(alice, "RemoveResourceAdmin", alice.id, "Q", dan.id)
+	l.mustS(bob, "RemoveResourceAdmin", bob.id, "Q", carol.id)
+	l.failS(carol, "AddPerm", carol.id, "Q", "download", js([]string{"Public"}), "", "")
+
+	// 接受属主的管理员不再留在管理员列表中
+	l.mustS(alice, "OfferOwnership", alice.id, "Q", bob.id)
+	l.mustS(bob, "AcceptOwnership", bob.id, "Q")
+	l.failS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+	if res := queryResource(t, l, "Q"); res.OwnerUID != bob.id || len(res.Admins) != 0 {
+		t.Fatalf("%+v", res)
+	}
+}
+
+/* ---------- 链码事件 ---------- */
+
+// lastEvent 返回上一笔交易发出的唯一事件
+func lastEvent(t *testing.T, l *ledger) ChaincodeEvent {
+	t.Helper()
+	if len(l.last.events) != 1 {
+		t.Fatalf("expected one event, got %d", len(l.last.events))
+	}
+	var ev ChaincodeEvent
+	for name, b := range l.last.events {
+		if err := json.Unmarshal(b, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.Type != name {
+			t.Fatalf("event name %s does not match type %s", name, ev.Type)
+		}
+	}
+	return ev
+}
+
+func TestEvents(t *testing.T) {
+	l := newLedger(t)
+	admin, alice, bob := newKey(), newKey(), newKey()
+	l.must("Register", admin.id, admin.pem, "Creator")
+	l.must("InitLedger", js([]string{admin.id}), "false")
+	if ev := lastEvent(t, l); ev.Type != eventConfigChanged || ev.Operation != "InitLedger" {
+		t.Fatalf("%+v", ev)
+	}
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+
+	steps := []struct {
+		k    *key
+		fn   string
+		args []string
+		want string
+	}{
+		{admin, "AddRole", []string{admin.id, "Reviewer"}, eventRoleAdded},
+		{admin, "AddRoleInheritance", []string{admin.id, "Reviewer", "Public"}, eventRoleInheritanceAdded},
+		{admin, "RemoveRoleInheritance", []string{admin.id, "Reviewer", "Public"}, eventRoleInheritanceRemoved},
+		{admin, "AssignRole", []string{admin.id, bob.id, "Reviewer"}, eventRoleAssigned},
+		{admin, "UnassignRole", []string{admin.id, bob.id, "Reviewer"}, eventRoleUnassigned},
+		{admin, "RemoveRole", []string{admin.id, "Reviewer"}, eventRoleRemoved},
+		{admin, "SetDefaultRole", []string{admin.id, "Public"}, eventConfigChanged},
+		{admin, "SetLegacyUserIDs", []string{admin.id, "false"}, eventConfigChanged},
+		{admin, "BackfillRoleIndex", []string{admin.id, js([]string{bob.id}), "true"}, eventRoleIndexBackfilled},
+		{alice, "AddResource", []string{alice.id, "Q"}, eventResourceAdded},
+		{alice, "AddPerm", []string{alice.id, "Q", "download", js([]string{"Public"}), "", ""}, eventPermGranted},
+		{bob, "CheckPerm", []string{"download", bob.id, "Q"}, eventAccessDecided},
+		{alice, "RevokePerm", []string{alice.id, "Q", "download", js([]string{"Public"})}, eventPermRevoked},
+		{alice, "AddResourceAdmin", []string{alice.id, "Q", bob.id, "false"}, eventResourceAdminAdded},
+		{alice, "RemoveResourceAdmin", []string{alice.id, "Q", bob.id}, eventResourceAdminRemoved},
+		{alice, "AddDenyRule", []string{alice.id, "Q", "download", "user:" + bob.id}, eventDenyRuleAdded},
+		{alice, "RemoveDenyRule", []string{alice.id, "Q", "download", "user:" + bob.id}, eventDenyRuleRemoved},
+		{alice, "OfferOwnership", []string{alice.id, "Q", bob.id}, eventOwnershipOffered},
+		{alice, "CancelOwnershipOffer", []string{alice.id, "Q"}, eventOwnershipOfferCancelled},
+		{alice, "OfferOwnership", []string{alice.id, "Q", bob.id}, eventOwnershipOffered},
+		{bob, "AcceptOwnership", []string{bob.id, "Q"}, eventOwnershipAccepted},
+		{bob, "RemoveResource", []string{bob.id, "Q"}, eventResourceRemoved},
+	}
+	for _, st := range steps {
+		l.mustS(st.k, st.fn, st.args...)
+		ev := lastEvent(t, l)
+		if ev.Type != st.want || ev.TxID != l.last.txid || ev.Time.IsZero() {
+			t.Fatalf("%s: %+v", st.fn, ev)
+		}
+	}
+	if ev := lastEvent(t, l); ev.UID != bob.id || ev.CID != "Q" {
+		t.Fatalf("%+v", ev)
+	}
+}
+
+/* ---------- 访问日志查询 ---------- */
+
+func tracePage(t *testing.T, out string) AccessLogPage {
+	t.Helper()
+	var p AccessLogPage
+	if err := json.Unmarshal([]byte(out), &p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTraceCidPaged(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Creator"}), "", "")
+	var bobTimes []time.Time
+	for i := 0; i < 5; i++ {
+		l.expectDecision(bob, "download", "Q", "Deny")
+		bobTimes = append(bobTimes, l.now)
+		l.expectDecision(alice, "download", "Q", "Permit")
+	}
+	l.seed("Q_log_zzz", "garbage")
+
+	// 按 uid 与 decision 过滤后逐页读完，无法解析的记录计入 Skipped
+	bm, n, skipped := "", 0, int32(0)
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("bookmark never ended")
+		}
+		p := tracePage(t, l.must("TraceCidPaged", "Q", "3", bm, "", "", bob.id, "Deny"))
+		if p.Fetched > 3 || int(p.Fetched) < len(p.Logs) {
+			t.Fatalf("%+v", p)
+		}
+		for _, e := range p.Logs {
+			if e.UID != bob.id || e.Decision != "Deny" {
+				t.Fatalf("%+v", e)
+			}
+		}
+		n += len(p.Logs)
+		skipped += p.Skipped
+		if bm = p.Bookmark; bm == "" {
+			break
+		}
+	}
+	if n != 5 || skipped != 1 {
+		t.Fatalf("logs=%d skipped=%d", n, skipped)
+	}
+
+	// 时间窗口含 from 不含 to
+	from, to := bobTimes[1].UTC().Format(time.RFC3339), bobTimes[3].UTC().Format(time.RFC3339)
+	p := tracePage(t, l.must("TraceCidPaged", "Q", "100", "", from, to, bob.id, ""))
+	if len(p.Logs) != 2 || !p.Logs[0].Time.Equal(bobTimes[1]) || !p.Logs[1].Time.Equal(bobTimes[2]) {
+		t.Fatalf("%+v", p.Logs)
+	}
+
+	l.fail("TraceCidPaged", "Q", "0", "", "", "", "", "")
+	l.fail("TraceCidPaged", "Q", "1001", "", "", "", "", "")
+	l.fail("TraceCidPaged", "Q", "10", "", "yesterday", "", "", "")
+}
+
+func TestTraceUser(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice, bob, carol := newKey(), newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.must("Register", carol.id, carol.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddResource", alice.id, "Q2")
+	l.expectDecision(bob, "download", "Q", "Deny")
+	l.expectDecision(bob, "download", "Q2", "Deny")
+	l.expectDecision(alice, "download", "Q2", "Deny")
+
+	// 本人可查询自己跨文件的记录，每条带上 cid
+	p := tracePage(t, l.mustS(bob, "TraceUser", bob.id, bob.id, "", "", "10", ""))
+	if len(p.Logs) != 2 {
+		t.Fatalf("%+v", p)
+	}
+	cids := map[string]bool{}
+	for _, e := range p.Logs {
+		if e.UID != bob.id {
+			t.Fatalf("%+v", e)
+		}
+		cids[e.CID] = true
+	}
+	if !cids["Q"] || !cids["Q2"] {
+		t.Fatalf("%+v", p.Logs)
+	}
+
+	// 非本人且不持有 Auditor 的用户被拒绝
+	l.failS(alice, "TraceUser", alice.id, bob.id, "", "", "10", "")
+
+	// Auditor 可直接持有，也可通过继承获得
+	l.mustS(admin, "AddRole", admin.id, auditorRole)
+	l.mustS(admin, "AssignRole", admin.id, alice.id, auditorRole)
+	if p := tracePage(t, l.mustS(alice, "TraceUser", alice.id, bob.id, "", "", "10", "")); len(p.Logs) != 2 {
+		t.Fatalf("%+v", p)
+	}
+	l.failS(carol, "TraceUser", carol.id, bob.id, "", "", "10", "")
+	l.mustS(admin, "AddRole", admin.id, "Compliance")
+	l.mustS(admin, "AddRoleInheritance", admin.id, "Compliance", auditorRole)
+	l.mustS(admin, "AssignRole", admin.id, carol.id, "Compliance")
+	l.mustS(carol, "TraceUser", carol.id, bob.id, "", "", "10", "")
+
+	// 签名覆盖全部参数，篡改分页大小即失败
+	l.fail("TraceUser", bob.proof("TraceUser", bob.id, bob.id, "", "", "10", ""), bob.id, bob.id, "", "", "11", "")
+}
+
+/* ---------- 未通过认证的拒绝 ---------- */
+
+func TestUnauthenticatedDenials(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice, bob, carol, mallory := newKey(), newKey(), newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.must("Register", carol.id, carol.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+
+	// 未注册用户，以及冒用 bob 身份的错误签名；不需要任何客户端属性即记入 unauthlog，
+	// 但不进入 cid 日志与被冒用用户的 uidlog
+	if d := l.mustS(mallory, "CheckPerm", "download", mallory.id, "Q"); d != "Deny" {
+		t.Fatal(d)
+	}
+	if d := l.must("CheckPerm", mallory.proof("CheckPerm", "download", bob.id, "Q"), "download", bob.id, "Q"); d != "Deny" {
+		t.Fatal(d)
+	}
+	out := l.must("CheckPermBatch", mallory.proof("CheckPermBatch", "download", bob.id, `["Q"]`), "download", bob.id, `["Q"]`)
+	if out != `{"Q":"Deny"}` {
+		t.Fatal(out)
+	}
+	if ev := lastEvent(t, l); ev.UID != "" || ev.ClaimedUID != bob.id || ev.Reason != denyReasonBadSignature {
+		t.Fatalf("%+v", ev)
+	}
+	p := tracePage(t, l.must("TraceUnauthenticated", "Q", "10", ""))
+	want := map[string]string{mallory.id: denyReasonUnknownUser, bob.id: denyReasonBadSignature}
+	if len(p.Logs) != 3 {
+		t.Fatalf("%+v", p.Logs)
+	}
+	for _, e := range p.Logs {
+		if e.UID != "" || e.Roles != nil || want[e.ClaimedUID] != e.Reason || e.Decision != "Deny" {
+			t.Fatalf("%+v", e)
+		}
+	}
+	if p := tracePage(t, l.must("TraceCidPaged", "Q", "100", "", "", "", "", "")); len(p.Logs) != 0 {
+		t.Fatalf("%+v", p.Logs)
+	}
+	if p := tracePage(t, l.mustS(bob, "TraceUser", bob.id, bob.id, "", "", "10", "")); len(p.Logs) != 0 {
+		t.Fatalf("%+v", p.Logs)
+	}
+
+	// 停用状态在验签之后判断：本人签名的请求以 user_suspended 记入自己的日志，伪造的签名仍是 bad_signature
+	l.mustS(admin, "SuspendUser", admin.id, carol.id)
+	l.expectDecision(carol, "download", "Q", "Deny")
+	if ev := lastEvent(t, l); ev.UID != carol.id || ev.Reason != denyReasonUserSuspended {
+		t.Fatalf("%+v", ev)
+	}
+	l.must("CheckPerm", mallory.proof("CheckPerm", "download", carol.id, "Q"), "download", carol.id, "Q")
+	if ev := lastEvent(t, l); ev.UID != "" || ev.Reason != denyReasonBadSignature {
+		t.Fatalf("%+v", ev)
+	}
+	p = tracePage(t, l.must("TraceCidPaged", "Q", "100", "", "", "", "", ""))
+	if len(p.Logs) != 1 || p.Logs[0].UID != carol.id || p.Logs[0].Reason != denyReasonUserSuspended {
+		t.Fatalf("%+v", p.Logs)
+	}
+
+	l.expectDecision(bob, "download", "Q", "Permit")
+}
+
+/* ---------- 只读预检与批量判定 ---------- */
+
+func TestEvaluatePerm(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+
+	evaluate := func(proof, operation string) AccessLog {
+		t.Helper()
+		var e AccessLog
+		if err := json.Unmarshal([]byte(l.must("EvaluatePerm", proof, operation, bob.id, "Q")), &e); err != nil {
+			t.Fatal(err)
+		}
+		if len(l.last.writes) != 0 || len(l.last.events) != 0 {
+			t.Fatalf("EvaluatePerm wrote %v", l.last.writes)
+		}
+		return e
+	}
+
+	// 不登记 nonce，同一凭据可反复评估
+	p := bob.proof("EvaluatePerm", "download", bob.id, "Q")
+	for i := 0; i < 2; i++ {
+		if e := evaluate(p, "download"); e.Decision != "Permit" || e.Role != "Public" || e.TxID != "" || !e.Time.Equal(l.now) {
+			t.Fatalf("%+v", e)
+		}
+	}
+	if e := evaluate(p, "upload"); e.Reason != denyReasonBadSignature {
+		t.Fatalf("%+v", e)
+	}
+	// CheckPerm 的凭据不能用于 EvaluatePerm
+	if e := evaluate(bob.proof("CheckPerm", "download", bob.id, "Q"), "download"); e.Reason != denyReasonBadSignature {
+		t.Fatalf("%+v", e)
+	}
+	if e := evaluate(bob.proof("EvaluatePerm", "upload", bob.id, "Q"), "upload"); e.Decision != "Deny" || e.Reason != denyReasonNoPolicy {
+		t.Fatalf("%+v", e)
+	}
+	if p := tracePage(t, l.must("TraceCidPaged", "Q", "10", "", "", "", "", "")); len(p.Logs) != 0 {
+		t.Fatalf("%+v", p.Logs)
+	}
+}
+
+func TestCheckPermBatch(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q1")
+	l.mustS(alice, "AddResource", alice.id, "Q2")
+	l.mustS(alice, "AddPerm", alice.id, "Q1", "download", js([]string{"Public"}), "", "")
+
+	cids := js([]string{"Q1", "Q2", "Q3"})
+	p := bob.proof("CheckPermBatch", "download", bob.id, cids)
+	if out := l.must("CheckPermBatch", p, "download", bob.id, cids); out != `{"Q1":"Permit","Q2":"Deny","Q3":"Deny"}` {
+		t.Fatal(out)
+	}
+	ev := lastEvent(t, l)
+	if ev.Type != eventAccessDecidedBatch || ev.UID != bob.id || len(ev.Decisions) != 3 || ev.Decisions["Q1"] != "Permit" {
+		t.Fatalf("%+v", ev)
+	}
+	// 每个 cid 各写一条日志，共用同一交易号
+	for cid, want := range map[string]string{"Q1": "Permit", "Q2": "Deny", "Q3": "Deny"} {
+		p := tracePage(t, l.must("TraceCidPaged", cid, "10", "", "", "", "", ""))
+		if len(p.Logs) != 1 || p.Logs[0].Decision != want || p.Logs[0].UID != bob.id || p.Logs[0].TxID != ev.TxID {
+			t.Fatalf("%s: %+v", cid, p.Logs)
+		}
+	}
+	if p := tracePage(t, l.mustS(bob, "TraceUser", bob.id, bob.id, "", "", "10", "")); len(p.Logs) != 3 {
+		t.Fatalf("%+v", p.Logs)
+	}
+
+	// 重放的凭据整批拒绝
+	if out := l.must("CheckPermBatch", p, "download", bob.id, cids); out != `{"Q1":"Deny","Q2":"Deny","Q3":"Deny"}` {
+		t.Fatal(out)
+	}
+	l.failS(bob, "CheckPermBatch", "download", bob.id, js([]string{"Q1", "Q1"}))
+	l.failS(bob, "CheckPermBatch", "download", bob.id, "[]")
+	l.failS(bob, "CheckPermBatch", "download", bob.id, js([]string{""}))
+	big := make([]string, batchMaxSize+1)
+	for i := range big {
+		big[i] = fmt.Sprintf("Q%d", i)
+	}
+	l.failS(bob, "CheckPermBatch", "download", bob.id, js(big))
+}
+
+/* ---------- 批量发布 ---------- */
+
+func TestAddResourceBatch(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q0")
+
+	grants := js([]PermGrantSpec{
+		{CID: "Q1", Operation: "download", Roles: []string{"Public"}},
+		{CID: "Q2", Operation: "download", Roles: []string{"Public", "Contributor"}, NotAfter: "2030-01-01T00:00:00Z"},
+	})
+	// 任一 cid 已存在、角色未定义或授权越出本批时不写入任何记录
+	l.failS(alice, "AddResourceBatch", alice.id, js([]string{"Q1", "Q0"}), grants)
+	l.failS(alice, "AddResourceBatch", alice.id, js([]string{"Q1", "Q2"}), js([]PermGrantSpec{{CID: "Q1", Operation: "download", Roles: []string{"Nope"}}}))
+	l.failS(alice, "AddResourceBatch", alice.id, js([]string{"Q1"}), js([]PermGrantSpec{{CID: "Q0", Operation: "download", Roles: []string{"Public"}}}))
+	l.failS(alice, "AddResourceBatch", alice.id, js([]string{"Q1", "Q2"}), "not json")
+	if _, ok := l.mock.State["Q1"]; ok {
+		t.Fatal("partial write")
+	}
+	// 签名同时覆盖资源与授权
+	p := alice.proof("AddResourceBatch", alice.id, js([]string{"Q1", "Q2"}), "")
+	l.fail("AddResourceBatch", p, alice.id, js([]string{"Q1", "Q2"}), grants)
+
+	var sum BatchSummary
+	if err := json.Unmarshal([]byte(l.mustS(alice, "AddResourceBatch", alice.id, js([]string{"Q1", "Q2"}), grants)), &sum); err != nil {
+		t.Fatal(err)
+	}
+	if len(sum.CIDs) != 2 || sum.Entries != 5 {
+		t.Fatalf("%+v", sum)
+	}
+	if ev := lastEvent(t, l); ev.Type != eventResourceAddedBatch || len(ev.CIDs) != 2 {
+		t.Fatalf("%+v", ev)
+	}
+	if out := l.mustS(bob, "CheckPermBatch", "download", bob.id, js([]string{"Q1", "Q2"})); out != `{"Q1":"Permit","Q2":"Permit"}` {
+		t.Fatal(out)
+	}
+
+	// 不带授权的批量注册
+	for _, none := range []string{"", "[]"} {
+		cid := "E" + none
+		l.mustS(alice, "AddResourceBatch", alice.id, js([]string{cid}), none)
+		if res := queryResource(t, l, cid); res.OwnerUID != alice.id {
+			t.Fatalf("%+v", res)
+		}
+	}
+}
+
+func TestAddPermBatch(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResourceBatch", alice.id, js([]string{"Q1", "Q2"}), "")
+
+	specs := []PermGrantSpec{
+		{CID: "Q1", Operation: "download", Roles: []string{"Public"}},
+		{CID: "Q2", Operation: "download", Roles: []string{"Public"}},
+		{CID: "Q1", Operation: "upload", Roles: []string{"Creator"}},
+	}
+	l.failS(bob, "AddPermBatch", bob.id, js(specs))
+	l.failS(alice, "AddPermBatch", alice.id, js(append(specs, PermGrantSpec{CID: "Q2", Operation: "x", Roles: []string{"Nope"}})))
+	l.failS(alice, "AddPermBatch", alice.id, js(append(specs, PermGrantSpec{CID: "Q3", Operation: "x", Roles: []string{"Public"}})))
+	l.failS(alice, "AddPermBatch", alice.id, "[]")
+	l.expectDecision(bob, "download", "Q1", "Deny")
+
+	var sum BatchSummary
+	if err := json.Unmarshal([]byte(l.mustS(alice, "AddPermBatch", alice.id, js(specs))), &sum); err != nil {
+		t.Fatal(err)
+	}
+	if len(sum.CIDs) != 2 || sum.Entries != 3 {
+		t.Fatalf("%+v", sum)
+	}
+	l.expectDecision(bob, "download", "Q2", "Permit")
+	l.expectDecision(alice, "upload", "Q1", "Permit")
+}
+
+/* ---------- 多算法用户密钥 ---------- */
+
+// anyKey 为 ECDSA P-256、Ed25519 或 RSA 用户密钥；raw 使 ECDSA 输出定长 r||s，pss 使 RSA 使用 PSS
+type anyKey struct {
+	signer crypto.Signer
+	pem    string
+	id     string
+	raw    bool
+	pss    bool
+}
+
+func newAnyKey(alg string) *anyKey {
+	var s crypto.Signer
+	switch alg {
+	case keyAlgECDSA:
+		s, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyAlgEd25519:
+		_, s, _ = ed25519.GenerateKey(rand.Reader)
+	default:
+		s, _ = rsa.GenerateKey(rand.Reader, 1024)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(s.Public())
+	h := sha256.Sum256(der)
+	return &anyKey{signer: s, pem: string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), id: fmt.Sprintf("%x", h)}
+}
+
+func (k *anyKey) signBytes(data []byte) string {
+	var sig []byte
+	sum := sha256.Sum256(data)
+	switch s := k.signer.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(s, data)
+	case *ecdsa.PrivateKey:
+		if k.raw {
+			r, ss, _ := ecdsa.Sign(rand.Reader, s, sum[:])
+			sig = make([]byte, 64)
+			r.FillBytes(sig[:32])
+			ss.FillBytes(sig[32:])
+		} else {
+			sig, _ = ecdsa.SignASN1(rand.Reader, s, sum[:])
+		}
+	case *rsa.PrivateKey:
+		if k.pss {
+			sig, _ = rsa.SignPSS(rand.Reader, s, crypto.SHA256, sum[:], nil)
+		} else {
+			sig, _ = rsa.SignPKCS1v15(rand.Reader, s, crypto.SHA256, sum[:])
+		}
+	}
+	return base64.StdEncoding.EncodeToString(sig)
+}
+
+func (k *anyKey) proof(fn string, args ...string) string {
+	nonceN++
+	n := fmt.Sprintf("n%d", nonceN)
+	exp := proofExpiry
+	return js(SignedProof{Nonce: n, Expiry: exp, Signature: k.signBytes(canonicalPayload(fn, args, n, exp))})
+}
+
+func TestKeyAlgorithms(t *testing.T) {
+	l := newLedger(t)
+	alice := newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+
+	ec, ecRaw, ed, pss := newAnyKey(keyAlgECDSA), newAnyKey(keyAlgECDSA), newAnyKey(keyAlgEd25519), newAnyKey(keyAlgRSA)
+	ecRaw.raw, pss.pss = true, true
+	for _, k := range []*anyKey{ec, ecRaw, ed, pss} {
+		l.must("Register", k.id, k.pem, "Public")
+		var u User
+		if err := json.Unmarshal([]byte(l.must("QueryUserID", k.id)), &u); err != nil {
+			t.Fatal(err)
+		}
+		if u.KeyAlg != keyAlgorithm(k.signer.Public()) {
+			t.Fatalf("keyAlg %s", u.KeyAlg)
+		}
+		args := []string{"download", k.id, "Q"}
+		if d := l.must("CheckPerm", append([]string{k.proof("CheckPerm", args...)}, args...)...); d != "Permit" {
+			t.Fatalf("%s: %s", u.KeyAlg, d)
+		}
+		if d := l.must("CheckPerm", append([]string{k.proof("CheckPerm", "upload", k.id, "Q")}, args...)...); d != "Deny" {
+			t.Fatalf("%s: %s", u.KeyAlg, d)
+		}
+	}
+
+	// 64 字节的签名先按 r||s 校验，失败后再按 DER 校验，两种格式都不能被篡改
+	payload := []byte("payload")
+	raw, _ := base64.StdEncoding.DecodeString(ecRaw.signBytes(payload))
+	raw[0] ^= 1
+	if verifyPayloadSignature(payload, base64.StdEncoding.EncodeToString(raw), ecRaw.signer.Public()) == nil {
+		t.Fatal("tampered r||s signature accepted")
+	}
+	if err := verifyPayloadSignature(payload, ecRaw.signBytes(payload), ecRaw.signer.Public()); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPayloadSignature(payload, ec.signBytes(payload), ec.signer.Public()); err != nil {
+		t.Fatal(err)
+	}
+
+	p384, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(p384.Public())
+	h := sha256.Sum256(der)
+	l.fail("Register", fmt.Sprintf("%x", h), string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), "Public")
+}
+
+/* ---------- 密钥轮换与用户状态 ---------- */
+
+// prover 为 key 与 anyKey 共有的凭据生成方法
+type prover interface {
+	proof(fn string, args ...string) string
+}
+
+func TestRotateKey(t *testing.T) {
+	l := newLedger(t)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+
+	nk := newAnyKey(keyAlgEd25519)
+	rotate := func(oldK, newK prover, pk string) []string {
+		return []string{oldK.proof("RotateKey", bob.id, pk), newK.proof("RotateKey", bob.id, pk), bob.id, pk}
+	}
+	// 两份凭据须分别由旧私钥与新私钥签名，且新公钥不能与当前公钥相同
+	l.fail("RotateKey", rotate(bob, bob, nk.pem)...)
+	l.fail("RotateKey", rotate(nk, nk, nk.pem)...)
+	l.fail("RotateKey", rotate(bob, bob, bob.pem)...)
+	l.must("RotateKey", rotate(bob, nk, nk.pem)...)
+	if ev := lastEvent(t, l); ev.Type != eventKeyRotated || ev.UID != bob.id {
+		t.Fatalf("%+v", ev)
+	}
+
+	var u User
+	if err := json.Unmarshal([]byte(l.must("QueryUserID", bob.id)), &u); err != nil {
+		t.Fatal(err)
+	}
+	oldFP, _ := keyFingerprint(bob.priv.Public())
+	if u.PK != nk.pem || u.KeyAlg != keyAlgEd25519 || len(u.PrevKeys) != 1 || u.PrevKeys[0].Fingerprint != oldFP || u.PrevKeys[0].KeyAlg != keyAlgRSA {
+		t.Fatalf("%+v", u)
+	}
+
+	// 旧私钥失效，新私钥沿用原 userID 与角色
+	l.expectDecision(bob, "download", "Q", "Deny")
+	args := []string{"download", bob.id, "Q"}
+	if d := l.must("CheckPerm", append([]string{nk.proof("CheckPerm", args...)}, args...)...); d != "Permit" {
+		t.Fatal(d)
+	}
+	// 换回用过的旧公钥被拒绝
+	l.fail("RotateKey", rotate(nk, bob, bob.pem)...)
+}
+
+func TestUserStatus(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.must("Register", bob.id, bob.pem, "Public")
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddPerm", alice.id, "Q", "download", js([]string{"Public"}), "", "")
+
+	l.failS(bob, "SuspendUser", bob.id, alice.id)
+	l.failS(admin, "SuspendUser", admin.id, admin.id)
+	l.mustS(admin, "SuspendUser", admin.id, bob.id)
+	if ev := lastEvent(t, l); ev.Type != eventUserStatusChanged || ev.UID != admin.id || ev.Target != bob.id || ev.Reason != userStatusSuspended {
+		t.Fatalf("%+v", ev)
+	}
+	l.failS(admin, "SuspendUser", admin.id, bob.id)
+	l.expectDecision(bob, "download", "Q", "Deny")
+
+	// 被暂停的属主不能提交签名交易
+	l.mustS(admin, "SuspendUser", admin.id, alice.id)
+	l.failS(alice, "AddPerm", alice.id, "Q", "upload", js([]string{"Public"}), "", "")
+	l.mustS(admin, "ReinstateUser", admin.id, alice.id)
+	l.mustS(alice, "AddPerm", alice.id, "Q", "upload", js([]string{"Public"}), "", "")
+
+	l.mustS(admin, "ReinstateUser", admin.id, bob.id)
+	l.expectDecision(bob, "download", "Q", "Permit")
+
+	// 吊销不可恢复
+	l.mustS(admin, "RevokeUser", admin.id, bob.id)
+	l.failS(admin, "ReinstateUser", admin.id, bob.id)
+	l.failS(admin, "SuspendUser", admin.id, bob.id)
+	l.expectDecision(bob, "download", "Q", "Deny")
+
+	p := tracePage(t, l.must("TraceCidPaged", "Q", "100", "", "", "", bob.id, "Deny"))
+	if len(p.Logs) != 2 || p.Logs[0].Reason != denyReasonUserSuspended || p.Logs[1].Reason != denyReasonUserRevoked {
+		t.Fatalf("%+v", p.Logs)
+	}
+}
+
+/* ---------- userID 与公钥绑定 ---------- */
+
+func TestUserIDBinding(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice, bob, carol := newKey(), newKey(), newKey()
+
+	// userID 须为公钥 SPKI 的哈希，不能自选或冒用他人的 ID
+	l.fail("Register", "free-form", alice.pem, "Public")
+	l.fail("Register", bob.id, alice.pem, "Public")
+	// 指纹只取决于公钥本身：PEM 后附加的内容与块头不影响 userID
+	l.must("Register", alice.id, alice.pem+"# junk", "Public")
+	block, _ := pem.Decode([]byte(bob.pem))
+	block.Type = "RSA PUBLIC KEY"
+	l.fail("Register", bob.id, string(pem.EncodeToMemory(block)), "Public")
+	block.Type = "PUBLIC KEY"
+	block.Headers = map[string]string{"Comment": "bob"}
+	l.must("Register", bob.id, string(pem.EncodeToMemory(block)), "Public")
+
+	// 旧版部署可开启 LegacyUserIDs 接受任意 userID
+	l.mustS(admin, "SetLegacyUserIDs", admin.id, "true")
+	l.must("Register", "free-form", carol.pem, "Public")
+	l.mustS(admin, "SetLegacyUserIDs", admin.id, "false")
+	l.fail("Register", "free-form-2", carol.pem, "Public")
+}
+
+// cid 与 userID 共用键空间：资源不能抢占尚未注册的 userID，也不能被当作用户引用
+func TestCIDCannotSquatUserID(t *testing.T) {
+	l := newLedger(t)
+	alice, victim := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Creator")
+	l.failS(alice, "AddResource", alice.id, victim.id)
+	l.failS(alice, "AddResourceBatch", alice.id, js([]string{"P", strings.ToUpper(victim.id)}), "")
+	l.must("Register", victim.id, victim.pem, "Public")
+
+	l.mustS(alice, "AddResource", alice.id, "Q")
+	l.mustS(alice, "AddResource", alice.id, "P")
+	if e := l.failS(alice, "AddResourceAdmin", alice.id, "Q", "P", "false"); !strings.Contains(e, "not found") {
+		t.Fatal(e)
+	}
+	if e := l.failS(alice, "GrantUserPerm", alice.id, "Q", "download", "P", "", ""); !strings.Contains(e, "not found") {
+		t.Fatal(e)
+	}
+	if e := l.failS(alice, "AddDenyRule", alice.id, "Q", "download", "user:P"); !strings.Contains(e, "not found") {
+		t.Fatal(e)
+	}
+	if e := l.fail("InitLedger", js([]string{"P"}), "false"); !strings.Contains(e, "not registered") {
+		t.Fatal(e)
+	}
+	l.mustS(alice, "GrantUserPerm", alice.id, "Q", "download", victim.id, "", "")
+}
+
+/* ---------- libp2p 节点绑定 ---------- */
+
+func b58enc(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	var out []byte
+	m := new(big.Int)
+	for n.Sign() > 0 {
+		n.DivMod(n, big.NewInt(58), m)
+		out = append([]byte{base58Alphabet[m.Int64()]}, out...)
+	}
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append([]byte{'1'}, out...)
+	}
+	return string(out)
+}
+
+// libp2pPub 按 libp2p crypto.pb 的 PublicKey 消息编码节点公钥
+func libp2pPub(k *anyKey) []byte {
+	var typ byte
+	var data []byte
+	switch p := k.signer.Public().(type) {
+	case ed25519.PublicKey:
+		typ, data = 1, p
+	case *rsa.PublicKey:
+		data, _ = x509.MarshalPKIXPublicKey(p)
+	case *ecdsa.PublicKey:
+		typ = 3
+		data, _ = x509.MarshalPKIXPublicKey(p)
+	}
+	out := []byte{0x08, typ, 0x12}
+	n := len(data)
+	for n >= 0x80 {
+		out = append(out, byte(n)|0x80)
+		n >>= 7
+	}
+	out = append(out, byte(n))
+	return append(out, data...)
+}
+
+// peerIDOf 返回节点 ID 与 BindPeer 的 peerKey 参数；Ed25519 使用 identity multihash 内嵌公钥，peerKey 留空
+func peerIDOf(k *anyKey) (string, string) {
+	pb := libp2pPub(k)
+	if _, ok := k.signer.(ed25519.PrivateKey); ok {
+		return b58enc(append([]byte{0x00, byte(len(pb))}, pb...)), ""
+	}
+	sum := sha256.Sum256(pb)
+	return b58enc(append([]byte{0x12, 0x20}, sum[:]...)), base64.StdEncoding.EncodeToString(pb)
+}
+
+func queryPeer(t *testing.T, l *ledger, peerID string) PeerBinding {
+	t.Helper()
+	var b PeerBinding
+	if err := json.Unmarshal([]byte(l.must("QueryUserByPeer", peerID)), &b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestBindPeer(t *testing.T) {
+	l := newLedger(t)
+	admin := setupAdmin(l)
+	alice, bob := newKey(), newKey()
+	l.must("Register", alice.id, alice.pem, "Public")
+	l.must("Register", bob.id, bob.pem, "Public")
+	edp, rsap, ecp := newAnyKey(keyAlgEd25519), newAnyKey(keyAlgRSA), newAnyKey(keyAlgECDSA)
+	edID, _ := peerIDOf(edp)
+	rsaID, rsaKey := peerIDOf(rsap)
+	ecID, ecKey := peerIDOf(ecp)
+	if !strings.HasPrefix(edID, "12D3KooW") {
+		t.Fatal(edID)
+	}
+
+	// bind 以用户 u 与节点 p 的签名提交 BindPeer(u.id, pid, pk)
+	bind := func(u *key, p *anyKey, pid, pk string) error {
+		pr := u.proof("BindPeer", u.id, pid, pk)
+		var sp SignedProof
+		if err := json.Unmarshal([]byte(pr), &sp); err != nil {
+			t.Fatal(err)
+		}
+		psig := p.signBytes(canonicalPayload("BindPeer", []string{u.id, pid, pk}, sp.Nonce, sp.Expiry))
+		_, err := l.invoke("BindPeer", pr, psig, u.id, pid, pk)
+		return err
+	}
+
+	if err := bind(alice, edp, edID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ev := lastEvent(t, l); ev.Type != eventPeerBound || ev.UID != alice.id {
+		t.Fatalf("%+v", ev)
+	}
+	if b := queryPeer(t, l, edID); b.UserID != alice.id || b.Status != "" || !b.BoundAt.Equal(l.now.Add(-time.Second)) {
+		t.Fatalf("%+v", b)
+	}
+	// 一个节点只能属于一个用户
+	if err := bind(bob, edp, edID, ""); err == nil {
+		t.Fatal("peer bound twice")
+	}
+	// 节点签名无效，或 peerKey 与节点 ID 不符
+	pr := bob.proof("BindPeer", bob.id, rsaID, rsaKey)
+	l.fail("BindPeer", pr, ecp.signBytes([]byte("x")), bob.id, rsaID, rsaKey)
+	if err := bind(bob, rsap, rsaID, ecKey); err == nil {
+		t.Fatal("mismatched peer key accepted")
+	}
+
+	// 重新绑定时旧节点解绑
+	if err := bind(bob, rsap, rsaID, rsaKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := bind(bob, ecp, ecID, ecKey); err != nil {
+		t.Fatal(err)
+	}
+	l.fail("QueryUserByPeer", rsaID)
+	if b := queryPeer(t, l, ecID); b.UserID != bob.id {
+		t.Fatalf("%+v", b)
+	}
+	l.fail("QueryUserByPeer", "not0base58")
+
+	// 被暂停用户的节点照常解析并带上状态，吊销后不再解析
+	l.mustS(admin, "SuspendUser", admin.id, bob.id)
+	if b := queryPeer(t, l, ecID); b.UserID != bob.id || b.Status != userStatusSuspended {
+		t.Fatalf("%+v", b)
+	}
+	l.mustS(admin, "RevokeUser", admin.id, bob.id)
+	l.fail("QueryUserByPeer", ecID)
+	if b := queryPeer(t, l, edID); b.UserID != alice.id {
+		t.Fatalf("%+v", b)
+	}
+}
+
+/* ---------- 注册权限 ---------- */
+
+func TestRegisterGate(t *testing.T) {
+	l := newLedger(t)
+	admin, alice, bob, carol := newKey(), newKey(), newKey(), newKey()
+	// 提交者只有运营方身份，没有 registrarAttr
+	l.attrs = map[string]string{bootstrapAttr: "true"}
+	l.fail("Register", admin.id, admin.pem, "Creator")
+	l.must("Register", admin.id, admin.pem, defaultSelfRole)
+	l.must("InitLedger", js([]string{admin.id}), "false")
+
+	// 自助注册只能获得默认角色，其余角色须由管理员 AdminRegister
+	if e := l.fail("Register", alice.id, alice.pem, "Creator"); !strings.Contains(e, registrarAttr) {
+		t.Fatal(e)
+	}
+	l.failS(alice, "AdminRegister", alice.id, alice.id, alice.pem, "Creator")
+	l.failS(admin, "AdminRegister", admin.id, alice.id, alice.pem, "Nope")
+	l.mustS(admin, "AdminRegister", admin.id, alice.id, alice.pem, "Creator")
+	if ev := lastEvent(t, l); ev.Type != eventUserRegistered || ev.UID != alice.id || ev.Role != "Creator" {
+		t.Fatalf("%+v", ev)
+	}
+	l.mustS(alice, "AddResource", alice.id, "Q")
+
+	// 默认角色可由管理员修改，但须为已定义的角色
+	l.failS(admin, "SetDefaultRole", admin.id, "Nope")
+	l.mustS(admin, "SetDefaultRole", admin.id, "Contributor")
+	l.fail("Register", bob.id, bob.pem, defaultSelfRole)
+	l.must("Register", bob.id, bob.pem, "Contributor")
+	// 当前默认角色不能删除，否则自助注册全部失败
+	l.mustS(admin, "AddRole", admin.id, "Guest")
+	l.mustS(admin, "SetDefaultRole", admin.id, "Guest")
+	if e := l.failS(admin, "RemoveRole", admin.id, "Guest"); !strings.Contains(e, "SetDefaultRole") {
+		t.Fatal(e)
+	}
+	l.mustS(admin, "SetDefaultRole", admin.id, "Contributor")
+	l.mustS(admin, "RemoveRole", admin.id, "Guest")
+
+	// 带 registrarAttr 的身份可直接注册任意角色
+	l.attrs[registrarAttr] = "true"
+	l.must("Register", carol.id, carol.pem, "Creator")
+	var u User
+	if err := json.Unmarshal([]byte(l.must("QueryUserID", carol.id)), &u); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Roles) != 1 || u.Roles[0] != "Creator" {
+		t.Fatalf("%+v", u)
+	}
+}
@@ -4,15 +4,18 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings" // 新增：用于修剪文件内容
 	"time"
 
@@ -49,6 +52,45 @@ func loadRSAPrivateKeyFromPEMFile(filename string) (*rsa.PrivateKey, error) {
 	return priv, nil
 }
 
+// canonicalPayload 与链码保持一致: 函数名、业务参数、nonce、expiry 依次编码为 "<字节长度>:<内容>,"
+func canonicalPayload(fn string, args []string, nonce string, expiry int64) []byte {
+	fields := append([]string{fn}, args...)
+	fields = append(fields, nonce, strconv.FormatInt(expiry, 10))
+	var buf []byte
+	for _, f := range fields {
+		buf = strconv.AppendInt(buf, int64(len(f)), 10)
+		buf = append(buf, ':')
+		buf = append(buf, f...)
+		buf = append(buf, ',')
+	}
+	return buf
+}
+
+// signProof 生成链码要求的签名凭据 JSON，有效期 5 分钟，nonce 随机生成防止重放
+func signProof(priv *rsa.PrivateKey, fn string, args ...string) (string, error) {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	expiry := time.Now().Add(5 * time.Minute).Unix()
+
+	digest := sha256.Sum256(canonicalPayload(fn, args, nonce, expiry))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	proof, err := json.Marshal(map[string]interface{}{
+		"nonce":  nonce,
+		"expiry": expiry,
+		"sig":    base64.StdEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(proof), nil
+}
+
 // ... [此处省略 newGrpcConnection, loadCertificate, newIdentity, newSign, handleError 函数，逻辑保持不变] ...
 
 /* -------------------- 主流程 -------------------- */
@@ -58,6 +100,8 @@ func main() {
 	const (
 		cid          = "QmdyzCHpa2vnn3zBvH1hfy4e5zdEuQGUvVfgtFfBnGFhKM"
 		operation    = "download"
+		notBefore    = "" // RFC3339，空串表示立即生效
+		notAfter     = "" // RFC3339，空串表示永不过期
 		mspID        = "Org1MSP"
 		cryptoPath   = "../../../test-network/organizations/peerOrganizations/org1.example.com"
 		certPath     = cryptoPath + "/users/User1@org1.example.com/msp/signcerts/User1@org1.example.com-cert.pem"
@@ -79,22 +123,17 @@ func main() {
 	}
 	fmt.Printf("资源属主 (User1) 哈希 ID: %s\n", uidStr)
 
-	// 加载属主私钥并对 uidStr + cid 签名
+	// 加载属主私钥并对 AddPerm 的全部参数签名
 	priv, err := loadRSAPrivateKeyFromPEMFile("../register/user_1_private_key.pem")
 	if err != nil {
 		log.Fatalf("加载 user_1 私钥失败: %v", err)
 	}
 
-	// 这里拼接的是哈希后的 uidStr 和 cid
-	dataToSign := uidStr + cid
-	h := crypto.SHA256.New()
-	h.Write([]byte(dataToSign))
-	digest := h.Sum(nil)
-	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest)
+	// 参数顺序与合约一致: uid (哈希串), cid, operation, rolesJSON, notBefore, notAfter
+	proof, err := signProof(priv, "AddPerm", uidStr, cid, operation, string(RJSON), notBefore, notAfter)
 	if err != nil {
 		log.Fatalf("签名失败: %v", err)
 	}
-	sigB64 := base64.StdEncoding.EncodeToString(sig)
 
 	// 连接 Fabric
 	clientConn := newGrpcConnection(peerEndpoint)
@@ -114,15 +153,17 @@ func main() {
 	network := gw.GetNetwork(channel)
 	contract := network.GetContract(chaincode)
 
-	// 调用合约：AddPerm(signature, uid, cid, operation, rolesJSON)
+	// 调用合约：AddPerm(proof, uid, cid, operation, rolesJSON, notBefore, notAfter)
 	fmt.Println("正在提交 AddPerm 交易...")
 	_, err = contract.SubmitTransaction(
 		"AddPerm",
-		sigB64,
+		proof,
 		uidStr, // 传递哈希字符串
 		cid,
 		operation,
 		string(RJSON),
+		notBefore,
+		notAfter,
 	)
 	if err != nil {
 		handleError(err)
@@ -4,14 +4,18 @@ import (
 	"crypto"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"encoding/pem"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings" // 新增：用于处理文件内容中的空格/换行
 	"time"
 
@@ -49,6 +53,45 @@ func loadRSAPrivateKeyFromPEMFile(filename string) (*rsa.PrivateKey, error) {
 	return priv, nil
 }
 
+// canonicalPayload 与链码保持一致: 函数名、业务参数、nonce、expiry 依次编码为 "<字节长度>:<内容>,"
+func canonicalPayload(fn string, args []string, nonce string, expiry int64) []byte {
+	fields := append([]string{fn}, args...)
+	fields = append(fields, nonce, strconv.FormatInt(expiry, 10))
+	var buf []byte
+	for _, f := range fields {
+		buf = strconv.AppendInt(buf, int64(len(f)), 10)
+		buf = append(buf, ':')
+		buf = append(buf, f...)
+		buf = append(buf, ',')
+	}
+	return buf
+}
+
+// signProof 生成链码要求的签名凭据 JSON，有效期 5 分钟，nonce 随机生成防止重放
+func signProof(priv *rsa.PrivateKey, fn string, args ...string) (string, error) {
+	nonceBytes := make([]byte, 16)
+	if _, err := rand.Read(nonceBytes); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(nonceBytes)
+	expiry := time.Now().Add(5 * time.Minute).Unix()
+
+	digest := sha256.Sum256(canonicalPayload(fn, args, nonce, expiry))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	proof, err := json.Marshal(map[string]interface{}{
+		"nonce":  nonce,
+		"expiry": expiry,
+		"sig":    base64.StdEncoding.EncodeToString(sig),
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(proof), nil
+}
+
 // ... [此处省略 newGrpcConnection, loadCertificate, newIdentity, newSign, handleError 函数，逻辑保持不变] ...
 
 /* -------------------- 主流程 -------------------- */
@@ -80,17 +123,11 @@ func main() {
 		log.Fatalf("加载 user_1 私钥失败: %v", err)
 	}
 
-	// 对 uidStr + cid 进行签名 (注意这里 uidStr 已经是哈希字符串了)
-	//dataToSign := uidStr + cid
-	dataToSign := uidStr
-	h := crypto.SHA256.New()
-	h.Write([]byte(dataToSign))
-	digest := h.Sum(nil)
-	sig, err := rsa.SignPKCS1v15(rand.Reader, priv, crypto.SHA256, digest)
+	// 签名凭据覆盖 uid 与 cid (注意这里 uidStr 已经是哈希字符串了)
+	proof, err := signProof(priv, "AddResource", uidStr, cid)
 	if err != nil {
 		log.Fatalf("签名失败: %v", err)
 	}
-	sigB64 := base64.StdEncoding.EncodeToString(sig)
 
 	// 连接 Fabric
 	clientConn := newGrpcConnection(peerEndpoint)
@@ -110,9 +147,9 @@ func main() {
 	network := gw.GetNetwork(channel)
 	contract := network.GetContract(chaincode)
 
-	// 调用 AddResource(signature, uid, cid)
+	// 调用 AddResource(proof, uid, cid)
 	fmt.Println("正在提交 AddResource 交易...")
-	_, err = contract.SubmitTransaction("AddResource", sigB64, uidStr, cid)
+	_, err = contract.SubmitTransaction("AddResource", proof, uidStr, cid)
 	if err != nil {
 		handleError(err)
 		log.Fatalf("AddResource 失败: %v", err)
@@ -109,13 +109,14 @@ func main() {
 	network := gw.GetNetwork(channel)
 	contract := network.GetContract(chaincode)
 
-	ownerBytes, err := contract.EvaluateTransaction("QueryCid", cid)
+	resBytes, err := contract.EvaluateTransaction("QueryCid", cid)
 	elapsedMs := float64(time.Since(start).Microseconds()) / 1000.0
 	if err != nil {
 		log.Fatalf("QueryCid 失败: %v", err)
 	}
 
-	fmt.Printf("QueryCid -> owner uid: %s\n", string(ownerBytes))
+	// 链码返回完整的资源记录 (属主、待接受的转移、属主变更历史)
+	fmt.Printf("QueryCid -> resource: %s\n", string(resBytes))
 	fmt.Printf("Client-side latency: %.3f ms\n", elapsedMs)
 	_ = context.TODO()
 }
@@ -28,8 +28,8 @@ type User struct {
 }
 
 type UserOnChain struct {
-	PK   string `json:"pk"`
-	Role string `json:"role"`
+	PK    string   `json:"pk"`
+	Roles []string `json:"roles"`
 }
 
 /* -------------------- 密钥与哈希工具 -------------------- */
@@ -42,9 +42,13 @@ func GenerateRSAKeys(bits int) (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	return priv, &priv.PublicKey, nil
 }
 
-// 获取公钥哈希作为 UserID
+// 获取公钥哈希作为 UserID：对 PEM 中的 DER (SPKI) 字节求哈希，与链码 Register 的校验一致
 func GetPublicKeyHash(pubPEM string) string {
-	hash := sha256.Sum256([]byte(pubPEM))
+	block, _ := pem.Decode([]byte(pubPEM))
+	if block == nil {
+		return ""
+	}
+	hash := sha256.Sum256(block.Bytes)
 	return hex.EncodeToString(hash[:])
 }
 
@@ -128,6 +132,7 @@ func main() {
 		fmt.Printf("[本地记录] 用户 Label=%s 生成的哈希ID为: %s\n", u.Label, realUserID)
 
 		// 5. 调用链码注册：使用生成的 realUserID (公钥哈希)
+		//    非默认角色 (Creator/Contributor) 要求本客户端证书带有 rbac.registrar=true 属性，否则须由管理员 AdminRegister
 		_, err = contract.SubmitTransaction(
 			"register",
 			realUserID, // 传入哈希值
@@ -13,11 +13,30 @@ const KEY_FILE = path.join(REGISTER_DIR, 'user_1_private_key.pem');
 // 硬编码 CID
 const FIXED_CID = "QmdyzCHpa2vnn3zBvH1hfy4e5zdEuQGUvVfgtFfBnGFhKM";
 
+// 与链码 canonicalPayload 保持一致: 函数名、业务参数、nonce、expiry 依次编码为 "<字节长度>:<内容>,"
+function canonicalPayload(fn, args, nonce, expiry) {
+    const fields = [fn, ...args, nonce, String(expiry)];
+    return Buffer.concat(fields.map(f => {
+        const b = Buffer.from(f, 'utf8');
+        return Buffer.concat([Buffer.from(`${b.length}:`), b, Buffer.from(',')]);
+    }));
+}
+
+// 每笔交易生成新的 nonce 与签名凭据，链码会拒绝重放的凭据
+function signProof(privateKeyPem, fn, args) {
+    const nonce = crypto.randomBytes(16).toString('hex');
+    const expiry = Math.floor(Date.now() / 1000) + 300;
+    const sign = crypto.createSign('SHA256');
+    sign.update(canonicalPayload(fn, args, nonce, expiry));
+    return JSON.stringify({ nonce, expiry, sig: sign.sign(privateKeyPem, 'base64') });
+}
+
 
 class AddPermWorkload extends WorkloadModuleBase {
     constructor() {
         super();
-        this.txArgs = []; // 预存的交易参数
+        this.privateKeyPem = '';
+        this.bizArgs = []; // 预存的业务参数，签名凭据每笔交易重新生成
     }
 
     async initializeWorkloadModule(workerIndex, totalWorkers, roundIndex,
@@ -35,27 +54,16 @@ class AddPermWorkload extends WorkloadModuleBase {
         if (!fs.existsSync(KEY_FILE)) {
             throw new Error(`找不到私钥文件: ${KEY_FILE}`);
         }
-        const privateKeyPem = fs.readFileSync(KEY_FILE, 'utf8');
+        this.privateKeyPem = fs.readFileSync(KEY_FILE, 'utf8');
 
-        // 3. 准备签名数据
-        // Go代码逻辑: dataToSign := uidStr + cid
-        const dataToSign = uidStr + FIXED_CID;
-        
-        // 4. 计算签名 (只计算一次)
-        const sign = crypto.createSign('SHA256');
-        sign.update(dataToSign);
-        const signatureB64 = sign.sign(privateKeyPem, 'base64');
-
-        // 5. 准备固定参数
-        // AddPerm(signature, uid, cid, operation, rolesJSON)
+        // 3. 准备固定业务参数
+        // AddPerm(proof, uid, cid, operation, rolesJSON, notBefore, notAfter)，有效期留空表示不限
         const operation = "download";
         const rolesJSON = JSON.stringify(["Creator", "Contributor"]);
 
         this.contractId = roundArguments.contractId || 'acmc';
         this.functionName = 'AddPerm';
-        
-        // 保存这一套固定的参数，供后续 submitTransaction 无限复用
-        this.txArgs = [signatureB64, uidStr, FIXED_CID, operation, rolesJSON];
+        this.bizArgs = [uidStr, FIXED_CID, operation, rolesJSON, '', ''];
         
         // 多组织负载均衡逻辑保持不变，用于模拟从不同节点发出的请求
         this._initInvokerStrategy(roundArguments);
@@ -81,11 +89,12 @@ class AddPermWorkload extends WorkloadModuleBase {
     }
 
     async submitTransaction() {
-        // 直接使用预生成的固定参数
+        // 凭据带一次性 nonce，不能跨交易复用
+        const proof = signProof(this.privateKeyPem, this.functionName, this.bizArgs);
         const req = {
             contractId: this.contractId,
             contractFunction: this.functionName,
-            contractArguments: this.txArgs, // <--- 这里直接用缓存
+            contractArguments: [proof, ...this.bizArgs],
             invokerIdentity: this._pickInvoker(),
             readOnly: false,
             timeout: 60
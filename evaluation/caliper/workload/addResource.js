@@ -40,7 +40,7 @@ class AddResourceWorkload extends WorkloadModuleBase {
         const privateKeyPem = fs.readFileSync(KEY_FILE, 'utf8');
 
         // 3. 预计算签名 (只对 UserID 签名，不包含 CID)
-        // 对应修改后的逻辑: dataToSign := uidStr
+        // 仅在链码以 InitLedger(adminsJSON, true) 开启测试模式时被接受
         const dataToSign = this.uidStr; 
         
         const sign = crypto.createSign('SHA256');
@@ -13,10 +13,29 @@ const KEY_FILE = path.join(REGISTER_DIR, 'user_2_private_key.pem'); // <--- User
 // 硬编码 CID
 const FIXED_CID = "QmdyzCHpa2vnn3zBvH1hfy4e5zdEuQGUvVfgtFfBnGFhKM";
 
+// 与链码 canonicalPayload 保持一致: 函数名、业务参数、nonce、expiry 依次编码为 "<字节长度>:<内容>,"
+function canonicalPayload(fn, args, nonce, expiry) {
+    const fields = [fn, ...args, nonce, String(expiry)];
+    return Buffer.concat(fields.map(f => {
+        const b = Buffer.from(f, 'utf8');
+        return Buffer.concat([Buffer.from(`${b.length}:`), b, Buffer.from(',')]);
+    }));
+}
+
+// 每笔交易生成新的 nonce 与签名凭据，链码会拒绝重放的凭据
+function signProof(privateKeyPem, fn, args) {
+    const nonce = crypto.randomBytes(16).toString('hex');
+    const expiry = Math.floor(Date.now() / 1000) + 300;
+    const sign = crypto.createSign('SHA256');
+    sign.update(canonicalPayload(fn, args, nonce, expiry));
+    return JSON.stringify({ nonce, expiry, sig: sign.sign(privateKeyPem, 'base64') });
+}
+
 class CheckPermWorkload extends WorkloadModuleBase {
     constructor() {
         super();
-        this.txArgs = []; // 预存的交易参数
+        this.privateKeyPem = '';
+        this.bizArgs = []; // 预存的业务参数，签名凭据每笔交易重新生成
     }
 
     async initializeWorkloadModule(workerIndex, totalWorkers, roundIndex,
@@ -34,26 +53,15 @@ class CheckPermWorkload extends WorkloadModuleBase {
         if (!fs.existsSync(KEY_FILE)) {
             throw new Error(`找不到私钥文件: ${KEY_FILE}`);
         }
-        const privateKeyPem = fs.readFileSync(KEY_FILE, 'utf8');
+        this.privateKeyPem = fs.readFileSync(KEY_FILE, 'utf8');
 
-        // 3. 准备签名数据
-        // Go代码逻辑: dataToSign := uidStr + cid
-        const dataToSign = uidStr + FIXED_CID;
-        
-        // 4. 计算签名 (只计算一次)
-        const sign = crypto.createSign('SHA256');
-        sign.update(dataToSign);
-        const signatureB64 = sign.sign(privateKeyPem, 'base64');
-
-        // 5. 准备固定参数
-        // 合约顺序: CheckPerm(signature, operation, userID, cid)
+        // 3. 准备固定业务参数
+        // 合约顺序: CheckPerm(proof, operation, userID, cid)
         const operation = "download";
 
         this.contractId = roundArguments.contractId || 'acmc';
         this.functionName = 'CheckPerm';
-        
-        // 保存这一套固定的参数，供后续 submitTransaction 无限复用
-        this.txArgs = [signatureB64, operation, uidStr, FIXED_CID];
+        this.bizArgs = [operation, uidStr, FIXED_CID];
         
         // 负载均衡策略
         this._initInvokerStrategy(roundArguments);
@@ -77,11 +85,12 @@ class CheckPermWorkload extends WorkloadModuleBase {
     }
 
     async submitTransaction() {
-        // 直接使用预生成的固定参数
+        // 凭据带一次性 nonce，不能跨交易复用
+        const proof = signProof(this.privateKeyPem, this.functionName, this.bizArgs);
         const req = {
             contractId: this.contractId,
             contractFunction: this.functionName,
-            contractArguments: this.txArgs, // <--- 复用 User2 的参数
+            contractArguments: [proof, ...this.bizArgs],
             invokerIdentity: this._pickInvoker(),
             readOnly: false, // 合约内有 logGen(PutState)，所以不是只读
             timeout: 60
@@ -17,6 +17,24 @@ const FIXED_CID = "QmdyzCHpa2vnn3zBvH1hfy4e5zdEuQGUvVfgtFfBnGFhKM";
 const FIXED_CID_1 = "QmdyzCHpa2vnn3zBvH1hfy4e5zdEuQGUvVfgtFfBnGFhKM_1";
 const FIXED_CID_2 = "QmdyzCHpa2vnn3zBvH1hfy4e5zdEuQGUvVfgtFfBnGFhKM_2";
 
+// 与链码 canonicalPayload 保持一致: 函数名、业务参数、nonce、expiry 依次编码为 "<字节长度>:<内容>,"
+function canonicalPayload(fn, args, nonce, expiry) {
+    const fields = [fn, ...args, nonce, String(expiry)];
+    return Buffer.concat(fields.map(f => {
+        const b = Buffer.from(f, 'utf8');
+        return Buffer.concat([Buffer.from(`${b.length}:`), b, Buffer.from(',')]);
+    }));
+}
+
+// 每笔交易生成新的 nonce 与签名凭据，链码会拒绝重放的凭据
+function signProof(privateKeyPem, fn, args) {
+    const nonce = crypto.randomBytes(16).toString('hex');
+    const expiry = Math.floor(Date.now() / 1000) + 300;
+    const sign = crypto.createSign('SHA256');
+    sign.update(canonicalPayload(fn, args, nonce, expiry));
+    return JSON.stringify({ nonce, expiry, sig: sign.sign(privateKeyPem, 'base64') });
+}
+
 function ensureDir(p) { fs.mkdirSync(p, { recursive: true }); }
 function safeLabel(s) { return String(s || '').replace(/[^\w.\-]+/g, '_'); }
 
@@ -58,8 +76,8 @@ class SystemMixWorkload extends WorkloadModuleBase {
         this.cum = [];
         
         // 缓存的用户凭证
-        this.u1 = { id: '', key: '', signAddRes: '', signAddPerm: '' };
-        this.u2 = { id: '', key: '', signCheckPerm: '' };
+        this.u1 = { id: '', key: '', signAddRes: '' };
+        this.u2 = { id: '', key: '' };
         
         // Register 用的 baseKey
         this.regBaseKey = '';
@@ -105,11 +123,7 @@ class SystemMixWorkload extends WorkloadModuleBase {
             const s1 = crypto.createSign('SHA256');
             s1.update(this.u1.id);
             this.u1.signAddRes = s1.sign(this.u1.key, 'base64');
-            
-            // 预计算 AddPerm 签名 (User1 对 uid+cid 签名)
-            const s2 = crypto.createSign('SHA256');
-            s2.update(this.u1.id + FIXED_CID_1);
-            this.u1.signAddPerm = s2.sign(this.u1.key, 'base64');
+            // AddPerm 凭据带一次性 nonce，在 _mkAddPerm 中逐笔生成
         } else {
             throw new Error('[SystemMix] User1 files missing');
         }
@@ -118,11 +132,7 @@ class SystemMixWorkload extends WorkloadModuleBase {
         if (fs.existsSync(ID2_FILE) && fs.existsSync(KEY2_FILE)) {
             this.u2.id = fs.readFileSync(ID2_FILE, 'utf8').trim();
             this.u2.key = fs.readFileSync(KEY2_FILE, 'utf8');
-            
-            // 预计算 CheckPerm 签名 (User2 对 uid+cid 签名)
-            const s3 = crypto.createSign('SHA256');
-            s3.update(this.u2.id + FIXED_CID);
-            this.u2.signCheckPerm = s3.sign(this.u2.key, 'base64');
+            // CheckPerm 凭据同样在 _mkCheckPerm 中逐笔生成
         } else {
             throw new Error('[SystemMix] User2 files missing');
         }
@@ -192,7 +202,7 @@ class SystemMixWorkload extends WorkloadModuleBase {
     _mkAddResource() {
         // User1 添加新资源 (随机 CID)
         const uniqueCid = `QmMix_${this.workerIndex}_${this.txIndex}_${Math.random().toString(36).slice(2)}`;
-        // 使用 User1 的静态签名 (只签了 uid)
+        // 使用 User1 的静态签名 (只签了 uid)，需要链码处于测试模式
         return {
             fn: 'AddResource',
             args: [this.u1.signAddRes, this.u1.id, uniqueCid],
@@ -204,10 +214,10 @@ class SystemMixWorkload extends WorkloadModuleBase {
         // User1 对 FIXED_CID 授权
         const operation = "download";
         const rolesJSON = JSON.stringify(["Public"]);
-        // 使用 User1 的静态签名 (签了 uid+FIXED_CID)
+        const args = [this.u1.id, FIXED_CID_1, operation, rolesJSON, '', ''];
         return {
             fn: 'AddPerm',
-            args: [this.u1.signAddPerm, this.u1.id, FIXED_CID_1, operation, rolesJSON],
+            args: [signProof(this.u1.key, 'AddPerm', args), ...args],
             readOnly: false
         };
     }
@@ -215,10 +225,10 @@ class SystemMixWorkload extends WorkloadModuleBase {
     _mkCheckPerm() {
         // User2 检查对 FIXED_CID 的权限
         const operation = "download";
-        // 使用 User2 的静态签名 (签了 uid+FIXED_CID)
+        const args = [operation, this.u2.id, FIXED_CID];
         return {
             fn: 'CheckPerm',
-            args: [this.u2.signCheckPerm, operation, this.u2.id, FIXED_CID],
+            args: [signProof(this.u2.key, 'CheckPerm', args), ...args],
             readOnly: false
         };
     }
@@ -158,6 +158,8 @@ class UserRegisterWorkload extends WorkloadModuleBase {
      * 策略：使用合法的 basePublicKey，但在其 PEM 尾部追加唯一标识（注释）。
      * Go 合约中的 pem.Decode 会忽略 END PUBLIC KEY 之后的内容，所以 key 依然合法。
      * 但 sha256 会计算整个字符串，所以 UserID 是唯一的。
+     * 注意：链码默认要求 UserID 为公钥 DER 的哈希，此类 ID 只有在管理员开启 SetLegacyUserIDs 后才能注册。
+     * 另外 Creator/Contributor 角色要求 Caliper 使用的客户端证书带有 rbac.registrar=true 属性。
      */
     _generateUserCredentials(index) {
         // 在 PEM 结尾追加唯一标识